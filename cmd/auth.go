@@ -0,0 +1,124 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"syscall"
+
+	"github.com/kdisneur/dropbox_sync/pkg/configuration"
+	"github.com/kdisneur/dropbox_sync/pkg/dropbox"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/crypto/ssh/terminal"
+)
+
+// Login authorizes the application on Dropbox and stores the token
+type Login struct {
+	// PasteCode asks for the authorization code instead of receiving it on a local redirect
+	PasteCode bool
+}
+
+// Run starts the authorization, replacing any stored token
+func (l Login) Run() {
+	config, err := configuration.LoadConfiguration()
+	if err != nil {
+		fail(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go cancelOnSignal(cancel)
+
+	_, err = authenticate(ctx, config, l.PasteCode)
+	if err != nil {
+		fail(err)
+	}
+
+	logrus.Info("dropbox authorization stored")
+}
+
+// Logout revokes the stored token on Dropbox and removes it
+type Logout struct{}
+
+// Run revokes and removes the stored token. The token is removed even when
+// Dropbox can't be reached
+func (l Logout) Run() {
+	config, err := configuration.LoadConfiguration()
+	if err != nil {
+		fail(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go cancelOnSignal(cancel)
+
+	client, err := configuration.LoadDropboxClient(config)
+	if err == nil {
+		err = dropbox.TokenRevoke(ctx, *client)
+		if err != nil {
+			logrus.Warnf("can't revoke dropbox token: %s", err)
+		}
+	}
+
+	err = configuration.RemoveDropboxToken()
+	if err != nil {
+		fail(err)
+	}
+
+	logrus.Info("dropbox authorization removed")
+}
+
+// authenticate asks the user to authorize the application and stores the token.
+// Dropbox redirects the browser to a local server receiving the authorization
+// code, unless the user prefers to paste it
+func authenticate(ctx context.Context, config *configuration.Config, pasteCode bool) (*dropbox.Client, error) {
+	oauth2 := config.OAuth2()
+
+	codeVerifier, err := dropbox.NewCodeVerifier()
+	if err != nil {
+		return nil, err
+	}
+
+	var code string
+	if pasteCode {
+		code, err = pasteAuthorizationCode(oauth2, codeVerifier)
+	} else {
+		oauth2, code, err = receiveAuthorizationCode(ctx, oauth2, config.Authentication.LoopbackPort(), codeVerifier)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	token, err := oauth2.GetAccessToken(ctx, code, codeVerifier)
+	if err != nil {
+		return nil, err
+	}
+
+	return configuration.SaveDropboxToken(config, *token)
+}
+
+func pasteAuthorizationCode(oauth2 dropbox.OAuth2, codeVerifier string) (string, error) {
+	fmt.Println("dropbox token not found. starts the authentication process.")
+	fmt.Printf("open your browser to authenticate: %s\n", oauth2.AuthorizationURL(codeVerifier))
+	fmt.Printf("enter the code: ")
+	code, err := terminal.ReadPassword(syscall.Stdin)
+	fmt.Println()
+
+	return string(code), err
+}
+
+func receiveAuthorizationCode(ctx context.Context, oauth2 dropbox.OAuth2, port int, codeVerifier string) (dropbox.OAuth2, string, error) {
+	loopback, err := oauth2.ListenLoopback(port)
+	if err != nil {
+		return oauth2, "", err
+	}
+	defer loopback.Close()
+
+	fmt.Fprintln(os.Stderr, "dropbox token not found. starts the authentication process.")
+	fmt.Fprintf(os.Stderr, "open your browser to authenticate: %s\n", loopback.AuthorizationURL(codeVerifier))
+
+	code, err := loopback.Wait(ctx)
+
+	return loopback.OAuth2, code, err
+}
@@ -0,0 +1,46 @@
+package cmd
+
+import (
+	"github.com/kdisneur/dropbox_sync/pkg/configuration"
+	"github.com/kdisneur/dropbox_sync/pkg/sync"
+	"github.com/sirupsen/logrus"
+)
+
+// ConfirmDeletions allows the deletions which paused a synchronization
+type ConfirmDeletions struct{}
+
+// Run confirms the deletions of every paused folder. A running synchronization
+// resumes within a second
+func (c ConfirmDeletions) Run() {
+	config, err := configuration.LoadConfiguration()
+	if err != nil {
+		fail(err)
+	}
+
+	confirmed := 0
+	for _, folder := range config.Folders {
+		pauseFolder, err := configuration.PauseFolder(folder)
+		if err != nil {
+			fail(err)
+		}
+
+		pauses, err := sync.Pauses(pauseFolder)
+		if err != nil {
+			fail(err)
+		}
+
+		for _, pause := range pauses {
+			err = pause.Confirm()
+			if err != nil {
+				fail(err)
+			}
+
+			logrus.Infof("deletions confirmed for '%s' (%s): %s", folder.LocalPath, pause.Direction, pause.Reason)
+			confirmed++
+		}
+	}
+
+	if confirmed == 0 {
+		logrus.Info("no synchronization paused")
+	}
+}
@@ -1,21 +1,30 @@
 package cmd
 
 import (
-	"fmt"
-	"golang.org/x/crypto/ssh/terminal"
+	"context"
 	"os"
-	"syscall"
+	gosync "sync"
+	"time"
 
 	"github.com/kdisneur/dropbox_sync/pkg/configuration"
 	"github.com/kdisneur/dropbox_sync/pkg/dropbox"
+	"github.com/kdisneur/dropbox_sync/pkg/local"
+	"github.com/kdisneur/dropbox_sync/pkg/state"
 	"github.com/kdisneur/dropbox_sync/pkg/sync"
 	"github.com/sirupsen/logrus"
 )
 
+// trashPurgeInterval is how often files kept too long in the trash are removed
+const trashPurgeInterval = time.Hour
+
 // Synchronize synchronize data between Dropbox and a local folder
-type Synchronize struct{}
+type Synchronize struct {
+	// PasteCode asks for the authorization code instead of receiving it on a local redirect
+	PasteCode bool
+}
 
-// Run starts the Dropbox <-> folder synchronization
+// Run starts the Dropbox <-> folder synchronization. It stops on the first error
+// or on SIGINT/SIGTERM, once in-flight transfers are done or rolled back
 func (s Synchronize) Run() {
 	var client *dropbox.Client
 	var err error
@@ -25,67 +34,199 @@ func (s Synchronize) Run() {
 		fail(err)
 	}
 
-	client, err = configuration.LoadDropboxClient()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go cancelOnSignal(cancel)
+
+	client, err = configuration.LoadDropboxClient(config)
+	if err != nil {
+		client, err = authenticate(ctx, config, s.PasteCode)
+	}
+
+	if err != nil {
+		fail(err)
+	}
+
+	deletionLimit, err := config.Deletions.Limit()
 	if err != nil {
-		client, err = s.authenticate(config)
+		fail(err)
+	}
+
+	trashRetention, err := config.Trash.RetentionPeriod()
+	if err != nil {
+		fail(err)
+	}
+
+	bandwidth, err := config.Bandwidth.Limiter()
+	if err != nil {
+		fail(err)
 	}
 
+	hashes, err := configuration.OpenHashCache()
 	if err != nil {
 		fail(err)
 	}
 
-	waitingErrors := make(chan error, 0)
+	waitingErrors := make(chan error, 3*len(config.Folders))
+	var running gosync.WaitGroup
+	var synchronizers []*sync.Sync
+	var stores []*state.Store
 
 	for _, folder := range config.Folders {
 		os.MkdirAll(folder.LocalPath, 0755)
 
-		synchronizer := sync.NewSync(client, folder.LocalPath, folder.RemotePath)
+		store, err := configuration.OpenState(folder)
+		if err != nil {
+			fail(err)
+		}
+		stores = append(stores, store)
+
+		matcher, err := folder.Matcher()
+		if err != nil {
+			fail(err)
+		}
+
+		mode, err := folder.SyncMode()
+		if err != nil {
+			fail(err)
+		}
+
+		pauseFolder, err := configuration.PauseFolder(folder)
+		if err != nil {
+			fail(err)
+		}
+
+		folderBandwidth, err := folder.Bandwidth.Limiter()
+		if err != nil {
+			fail(err)
+		}
+
+		folderClient := *client
+		folderClient.Limiters = nil
+		for _, limiter := range []*dropbox.BandwidthLimiter{bandwidth, folderBandwidth} {
+			if limiter != nil {
+				folderClient.Limiters = append(folderClient.Limiters, limiter)
+			}
+		}
+
+		synchronizer := sync.NewSync(&folderClient, store, matcher, mode, folder.LocalPath, folder.RemotePath)
+		synchronizer.DeletionLimit = deletionLimit
+		synchronizer.PauseFolder = pauseFolder
+		synchronizer.Transfers = config.Transfers.Parallel()
+		synchronizer.UseHashCache(hashes)
+		synchronizers = append(synchronizers, synchronizer)
+
+		running.Add(1)
+		go s.startSynchronizing(ctx, synchronizer, &running, waitingErrors)
+
+		if trashRetention > 0 {
+			running.Add(1)
+			go s.startPurgingTrash(ctx, synchronizer.Trash, trashRetention, &running)
+		}
+	}
 
-		go s.startScanningDropbox(synchronizer, waitingErrors)
-		go s.startScanningLocal(synchronizer, waitingErrors)
+	stopped := make(chan struct{})
+	go func() {
+		running.Wait()
+		close(stopped)
+	}()
+
+	select {
+	case err = <-waitingErrors:
+		cancel()
+		<-stopped
+	case <-stopped:
 	}
 
-	err = <-waitingErrors
-	fail(err)
-}
+	for _, synchronizer := range synchronizers {
+		synchronizer.Close()
 
-func (s Synchronize) authenticate(config *configuration.Config) (*dropbox.Client, error) {
-	oauth2 := dropbox.NewOAuth2(config.Authentication.ClientID, config.Authentication.ClientSecret)
+		logrus.
+			WithField("conflicts", synchronizer.Conflicts()).
+			Infof("stop syncing local folder '%s' with Dropbox '%s' path", synchronizer.LocalBasePath, synchronizer.RemoteBasePath)
+	}
 
-	fmt.Println("dropbox token not found. starts the authentication process.")
-	fmt.Printf("open your browser to authenticate: %s\n", oauth2.AuthorizationURL())
-	fmt.Printf("enter the code: ")
-	authorizationCode, err := terminal.ReadPassword(syscall.Stdin)
-	fmt.Println()
-	if err != nil {
-		return nil, err
+	for _, store := range stores {
+		closeErr := store.Close()
+		if closeErr != nil {
+			logrus.Errorf("can't flush synchronization state: %s", closeErr)
+		}
+	}
+
+	closeErr := hashes.Close()
+	if closeErr != nil {
+		logrus.Errorf("can't flush hash cache: %s", closeErr)
 	}
 
-	token, err := oauth2.GetAccessToken(string(authorizationCode))
 	if err != nil {
-		return nil, err
+		fail(err)
 	}
 
-	client, err := configuration.SaveDropboxToken(token)
+	logrus.Info("synchronization stopped")
+}
+
+func (s Synchronize) startSynchronizing(ctx context.Context, synchronizer *sync.Sync, running *gosync.WaitGroup, errors chan error) {
+	defer running.Done()
+
+	err := synchronizer.Reconcile(ctx)
 	if err != nil {
-		return nil, err
+		s.report(ctx, err, errors)
+		return
 	}
 
-	return client, nil
+	running.Add(2)
+	go s.startScanningDropbox(ctx, synchronizer, running, errors)
+	go s.startScanningLocal(ctx, synchronizer, running, errors)
 }
 
-func (s Synchronize) startScanningDropbox(synchronizer *sync.Sync, errors chan error) {
+func (s Synchronize) startScanningDropbox(ctx context.Context, synchronizer *sync.Sync, running *gosync.WaitGroup, errors chan error) {
+	defer running.Done()
+
 	logrus.Infof("start syncing Dropbox folder '%s' to local '%s' path", synchronizer.RemoteBasePath, synchronizer.LocalBasePath)
-	err := synchronizer.DropboxFolder()
+	err := synchronizer.DropboxFolder(ctx)
 	if err != nil {
-		errors <- err
+		s.report(ctx, err, errors)
 	}
 }
 
-func (s Synchronize) startScanningLocal(synchronizer *sync.Sync, errors chan error) {
+func (s Synchronize) startScanningLocal(ctx context.Context, synchronizer *sync.Sync, running *gosync.WaitGroup, errors chan error) {
+	defer running.Done()
+
 	logrus.Infof("start syncing local folder '%s' to Dropbox '%s' path", synchronizer.LocalBasePath, synchronizer.RemoteBasePath)
-	err := synchronizer.LocalFolder()
+	err := synchronizer.LocalFolder(ctx)
 	if err != nil {
-		errors <- err
+		s.report(ctx, err, errors)
+	}
+}
+
+// startPurgingTrash removes the files kept in the trash for longer than the
+// retention, now and then every hour
+func (s Synchronize) startPurgingTrash(ctx context.Context, trash *local.Trash, retention time.Duration, running *gosync.WaitGroup) {
+	defer running.Done()
+
+	for {
+		purged, err := trash.Purge(time.Now().Add(-retention))
+		if err != nil {
+			logrus.Warnf("can't purge trash: %s", err)
+		}
+
+		if purged > 0 {
+			logrus.Infof("%d trash batches older than %s purged", purged, retention)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(trashPurgeInterval):
+		}
 	}
 }
+
+// report sends an error unless it comes from the synchronization being stopped
+func (s Synchronize) report(ctx context.Context, err error, errors chan error) {
+	if ctx.Err() != nil {
+		return
+	}
+
+	errors <- err
+}
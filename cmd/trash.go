@@ -0,0 +1,95 @@
+package cmd
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/kdisneur/dropbox_sync/pkg/configuration"
+	"github.com/kdisneur/dropbox_sync/pkg/local"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// TrashList lists the local files removed or overwritten by the synchronizer
+type TrashList struct{}
+
+// Run prints the files kept in the trash of every folder, the most recently
+// removed first
+func (t TrashList) Run() {
+	config, err := configuration.LoadConfiguration()
+	if err != nil {
+		fail(err)
+	}
+
+	for _, folder := range config.Folders {
+		files, err := local.NewTrash(folder.LocalPath).List()
+		if err != nil {
+			fail(err)
+		}
+
+		for _, file := range files {
+			fmt.Printf("%s  %s  %s\n", file.DeletedAt.Local().Format(time.RFC3339), file.Batch, filepath.Join(folder.LocalPath, file.RelativePath))
+		}
+	}
+}
+
+// TrashRestore moves a file or a folder back from the trash
+type TrashRestore struct {
+	// Path is the local path of the file to restore
+	Path string
+	// Batch is the trash batch to restore from, the most recent one holding the file when empty
+	Batch string
+}
+
+// Run restores the file, which is then synchronized again
+func (t TrashRestore) Run() {
+	config, err := configuration.LoadConfiguration()
+	if err != nil {
+		fail(err)
+	}
+
+	if t.Path == "" {
+		fail(errors.New("missing path of the file to restore"))
+	}
+
+	localPath, err := filepath.Abs(t.Path)
+	if err != nil {
+		fail(err)
+	}
+
+	folder, ok := config.FolderOf(localPath)
+	if !ok {
+		fail(errors.Errorf("'%s' isn't in a synchronized folder", localPath))
+	}
+
+	relativePath := strings.TrimPrefix(localPath, filepath.Clean(folder.LocalPath))
+
+	err = local.NewTrash(folder.LocalPath).Restore(relativePath, t.Batch)
+	if err != nil {
+		fail(err)
+	}
+
+	logrus.Infof("'%s' restored", localPath)
+}
+
+// TrashPurge empties the trash
+type TrashPurge struct{}
+
+// Run removes every file kept in the trash of every folder
+func (t TrashPurge) Run() {
+	config, err := configuration.LoadConfiguration()
+	if err != nil {
+		fail(err)
+	}
+
+	for _, folder := range config.Folders {
+		purged, err := local.NewTrash(folder.LocalPath).Purge(time.Time{})
+		if err != nil {
+			fail(err)
+		}
+
+		logrus.Infof("%d trash batches purged in '%s'", purged, folder.LocalPath)
+	}
+}
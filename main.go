@@ -1,6 +1,7 @@
 package main
 
 import (
+	"fmt"
 	"os"
 
 	"github.com/kdisneur/dropbox_sync/cmd"
@@ -18,6 +19,10 @@ func main() {
 	var versionFlag bool
 	pflag.BoolVarP(&versionFlag, "version", "v", false, "show version number")
 
+	var pasteCodeFlag bool
+	pflag.BoolVar(&pasteCodeFlag, "paste-code", false, "authenticate by pasting the code shown by Dropbox instead of a local redirect")
+
+	pflag.Usage = usage
 	pflag.Parse()
 
 	setupLogger(debuggingFlag)
@@ -32,7 +37,40 @@ func main() {
 		os.Exit(0)
 	}
 
-	cmd.Synchronize{}.Run()
+	switch command := pflag.Arg(0) + " " + pflag.Arg(1); command {
+	case " ":
+		cmd.Synchronize{PasteCode: pasteCodeFlag}.Run()
+	case "auth login":
+		cmd.Login{PasteCode: pasteCodeFlag}.Run()
+	case "auth logout":
+		cmd.Logout{}.Run()
+	case "deletions confirm":
+		cmd.ConfirmDeletions{}.Run()
+	case "trash list":
+		cmd.TrashList{}.Run()
+	case "trash restore":
+		cmd.TrashRestore{Path: pflag.Arg(2), Batch: pflag.Arg(3)}.Run()
+	case "trash purge":
+		cmd.TrashPurge{}.Run()
+	default:
+		fmt.Fprintf(os.Stderr, "unknown command: %s\n", command)
+		pflag.Usage()
+		os.Exit(2)
+	}
+}
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "Usage of %s:\n", os.Args[0])
+	fmt.Fprintf(os.Stderr, "  %s [flags]                             synchronize the configured folders\n", os.Args[0])
+	fmt.Fprintf(os.Stderr, "  %s [flags] auth login                  authorize the access to Dropbox\n", os.Args[0])
+	fmt.Fprintf(os.Stderr, "  %s [flags] auth logout                 revoke the access to Dropbox\n", os.Args[0])
+	fmt.Fprintf(os.Stderr, "  %s [flags] deletions confirm           resume the synchronizations paused after too many deletions\n", os.Args[0])
+	fmt.Fprintf(os.Stderr, "  %s [flags] trash list                  list the local files removed or overwritten\n", os.Args[0])
+	fmt.Fprintf(os.Stderr, "  %s [flags] trash restore PATH [BATCH]  move a file back from the trash\n", os.Args[0])
+	fmt.Fprintf(os.Stderr, "  %s [flags] trash purge                 empty the trash\n", os.Args[0])
+	fmt.Fprintln(os.Stderr)
+	fmt.Fprintln(os.Stderr, "Flags:")
+	pflag.PrintDefaults()
 }
 
 func setupLogger(withDebugging bool) {
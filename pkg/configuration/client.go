@@ -1,8 +1,11 @@
 package configuration
 
 import (
+	"encoding/json"
 	"io/ioutil"
+	"os"
 	"path"
+	"strings"
 
 	"github.com/kdisneur/dropbox_sync/pkg/dropbox"
 	homedir "github.com/mitchellh/go-homedir"
@@ -12,35 +15,92 @@ import (
 var tokenFilePath = path.Join("~", ".config", "dropbox_sync", "token")
 
 // LoadDropboxClient load the dropbox client from a stored token
-func LoadDropboxClient() (*dropbox.Client, error) {
+func LoadDropboxClient(config *Config) (*dropbox.Client, error) {
 	filePath, err := homedir.Expand(tokenFilePath)
 	if err != nil {
 		return nil, errors.Wrap(err, "can't find HOME folder")
 	}
 
-	token, err := ioutil.ReadFile(filePath)
+	content, err := ioutil.ReadFile(filePath)
 	if err != nil {
 		return nil, errors.Wrap(err, "can't read token file")
 	}
 
-	client := dropbox.NewClient(string(token))
+	token, err := parseToken(content)
+	if err != nil {
+		return nil, err
+	}
 
-	return &client, nil
+	return newDropboxClient(config, token)
 }
 
 // SaveDropboxToken store the token on file and returns a client
-func SaveDropboxToken(token string) (*dropbox.Client, error) {
-	filePath, err := homedir.Expand(tokenFilePath)
+func SaveDropboxToken(config *Config, token dropbox.Token) (*dropbox.Client, error) {
+	err := saveToken(token)
 	if err != nil {
-		return nil, errors.Wrap(err, "can't find HOME folder")
+		return nil, err
 	}
 
-	err = ioutil.WriteFile(filePath, []byte(token), 0600)
+	return newDropboxClient(config, token)
+}
+
+// RemoveDropboxToken deletes the stored token, if any
+func RemoveDropboxToken() error {
+	filePath, err := homedir.Expand(tokenFilePath)
 	if err != nil {
-		return nil, errors.Wrap(err, "can't write token file")
+		return errors.Wrap(err, "can't find HOME folder")
 	}
 
-	client := dropbox.NewClient(token)
+	err = os.Remove(filePath)
+	if os.IsNotExist(err) {
+		return nil
+	}
+
+	return errors.Wrap(err, "can't remove token file")
+}
+
+func newDropboxClient(config *Config, token dropbox.Token) (*dropbox.Client, error) {
+	client := dropbox.NewRefreshingClient(config.OAuth2(), token, saveToken)
+
+	policy, err := config.Retry.Policy()
+	if err != nil {
+		return nil, err
+	}
+	client.RetryPolicy = policy
+	client.Endpoints = config.Endpoints.Dropbox()
 
 	return &client, nil
 }
+
+func saveToken(token dropbox.Token) error {
+	filePath, err := homedir.Expand(tokenFilePath)
+	if err != nil {
+		return errors.Wrap(err, "can't find HOME folder")
+	}
+
+	content, err := json.Marshal(token)
+	if err != nil {
+		return errors.Wrap(err, "can't encode token")
+	}
+
+	err = ioutil.WriteFile(filePath, content, 0600)
+
+	return errors.Wrap(err, "can't write token file")
+}
+
+// parseToken reads a token file. Files written before refresh tokens were
+// supported only contain a long-lived access token
+func parseToken(content []byte) (dropbox.Token, error) {
+	trimmed := strings.TrimSpace(string(content))
+	if !strings.HasPrefix(trimmed, "{") {
+		return dropbox.Token{AccessToken: trimmed}, nil
+	}
+
+	var token dropbox.Token
+	err := json.Unmarshal(content, &token)
+	if err != nil {
+		return token, errors.Wrap(err, "can't parse token file")
+	}
+
+	return token, nil
+}
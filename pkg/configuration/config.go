@@ -1,9 +1,19 @@
 package configuration
 
 import (
+	"crypto/sha1"
+	"fmt"
 	"os"
 	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
 
+	"github.com/kdisneur/dropbox_sync/pkg/dropbox"
+	"github.com/kdisneur/dropbox_sync/pkg/ignore"
+	"github.com/kdisneur/dropbox_sync/pkg/local"
+	"github.com/kdisneur/dropbox_sync/pkg/sync"
 	homedir "github.com/mitchellh/go-homedir"
 	toml "github.com/pelletier/go-toml"
 	"github.com/pkg/errors"
@@ -12,19 +22,350 @@ import (
 // Config represents the configuration file
 type Config struct {
 	Authentication DropboxAuthentication `toml:"authentication"`
+	Bandwidth      Bandwidth             `toml:"bandwidth"`
+	Deletions      Deletions             `toml:"deletions"`
+	Endpoints      Endpoints             `toml:"endpoints"`
 	Folders        []Folder              `toml:"folder"`
+	Retry          Retry                 `toml:"retry"`
+	Transfers      Transfers             `toml:"transfers"`
+	Trash          Trash                 `toml:"trash"`
 }
 
 // DropboxAuthentication represents the Dropbox authentication configuration
 type DropboxAuthentication struct {
 	ClientID     string `toml:"client_id"`
 	ClientSecret string `toml:"client_secret"`
+	RedirectPort int    `toml:"redirect_port"`
 }
 
-// Folder represents a folder to synchronize
+// LoopbackPort returns the port of the local redirect URI used during the authorization
+func (a DropboxAuthentication) LoopbackPort() int {
+	if a.RedirectPort > 0 {
+		return a.RedirectPort
+	}
+
+	return dropbox.DefaultLoopbackPort
+}
+
+// OAuth2 returns the OAuth2 configuration used to authenticate and renew access tokens
+func (c *Config) OAuth2() dropbox.OAuth2 {
+	oauth2 := dropbox.NewOAuth2(c.Authentication.ClientID, c.Authentication.ClientSecret)
+	oauth2.API = c.Endpoints.Dropbox().API
+
+	return oauth2
+}
+
+// Endpoints represents the base URLs of the Dropbox API, like a proxy gateway or a
+// local fake Dropbox. Missing fields use the real Dropbox URLs
+type Endpoints struct {
+	API     string `toml:"api"`
+	Content string `toml:"content"`
+	Notify  string `toml:"notify"`
+}
+
+// Dropbox returns the Dropbox endpoints, using the default values for missing fields
+func (e Endpoints) Dropbox() dropbox.Endpoints {
+	endpoints := dropbox.DefaultEndpoints
+
+	if e.API != "" {
+		endpoints.API = e.API
+	}
+
+	if e.Content != "" {
+		endpoints.Content = e.Content
+	}
+
+	if e.Notify != "" {
+		endpoints.Notify = e.Notify
+	}
+
+	return endpoints
+}
+
+// Retry represents how failed Dropbox requests are sent again. Durations use the
+// Go syntax, like "500ms" or "1m"
+type Retry struct {
+	InitialBackoff string `toml:"initial_backoff"`
+	MaxAttempts    int    `toml:"max_attempts"`
+	MaxBackoff     string `toml:"max_backoff"`
+}
+
+// Policy returns the Dropbox retry policy, using the default values for missing fields
+func (r Retry) Policy() (dropbox.RetryPolicy, error) {
+	policy := dropbox.DefaultRetryPolicy
+
+	if r.MaxAttempts > 0 {
+		policy.MaxAttempts = r.MaxAttempts
+	}
+
+	var err error
+	if r.InitialBackoff != "" {
+		policy.InitialBackoff, err = time.ParseDuration(r.InitialBackoff)
+		if err != nil {
+			return policy, errors.Wrap(err, "can't parse retry initial backoff")
+		}
+	}
+
+	if r.MaxBackoff != "" {
+		policy.MaxBackoff, err = time.ParseDuration(r.MaxBackoff)
+		if err != nil {
+			return policy, errors.Wrap(err, "can't parse retry max backoff")
+		}
+	}
+
+	return policy, nil
+}
+
+// Bandwidth represents the transfer rates allowed per second, like "500KB" or
+// "2MB", where a KB is 1024 bytes. Empty or "0" is unlimited. Schedule overrides
+// them at some times of the day
+type Bandwidth struct {
+	Download string            `toml:"download"`
+	Schedule []BandwidthPeriod `toml:"schedule"`
+	Upload   string            `toml:"upload"`
+}
+
+// BandwidthPeriod represents the rates allowed every day between two times of
+// the day, like "22:00" and "07:00"
+type BandwidthPeriod struct {
+	Download string `toml:"download"`
+	From     string `toml:"from"`
+	To       string `toml:"to"`
+	Upload   string `toml:"upload"`
+}
+
+// Limiter returns the bandwidth limiter following the configured rates, or nil
+// when no rate is configured
+func (b Bandwidth) Limiter() (*dropbox.BandwidthLimiter, error) {
+	if b.Download == "" && b.Upload == "" && len(b.Schedule) == 0 {
+		return nil, nil
+	}
+
+	limit, err := parseBandwidthLimit(b.Download, b.Upload)
+	if err != nil {
+		return nil, err
+	}
+
+	schedule := dropbox.BandwidthSchedule{Limit: limit}
+	for _, period := range b.Schedule {
+		limit, err := parseBandwidthLimit(period.Download, period.Upload)
+		if err != nil {
+			return nil, err
+		}
+
+		from, err := parseTimeOfDay(period.From)
+		if err != nil {
+			return nil, err
+		}
+
+		to, err := parseTimeOfDay(period.To)
+		if err != nil {
+			return nil, err
+		}
+
+		schedule.Periods = append(schedule.Periods, dropbox.BandwidthPeriod{From: from, Limit: limit, To: to})
+	}
+
+	return dropbox.NewBandwidthLimiter(schedule), nil
+}
+
+func parseBandwidthLimit(download string, upload string) (dropbox.BandwidthLimit, error) {
+	var limit dropbox.BandwidthLimit
+	var err error
+
+	limit.Download, err = parseRate(download)
+	if err != nil {
+		return limit, errors.Wrap(err, "can't parse download bandwidth")
+	}
+
+	limit.Upload, err = parseRate(upload)
+	if err != nil {
+		return limit, errors.Wrap(err, "can't parse upload bandwidth")
+	}
+
+	return limit, nil
+}
+
+// parseRate parses a number of bytes per second like "500KB", "1.5MB" or "1024"
+func parseRate(rate string) (int64, error) {
+	number := strings.ToUpper(strings.TrimSpace(rate))
+	if number == "" {
+		return 0, nil
+	}
+
+	unit := int64(1)
+	for _, suffix := range []struct {
+		name string
+		size int64
+	}{{"GB", 1 << 30}, {"MB", 1 << 20}, {"KB", 1 << 10}, {"B", 1}} {
+		if strings.HasSuffix(number, suffix.name) {
+			number = strings.TrimSpace(strings.TrimSuffix(number, suffix.name))
+			unit = suffix.size
+			break
+		}
+	}
+
+	value, err := strconv.ParseFloat(number, 64)
+	if err != nil || value < 0 {
+		return 0, errors.Errorf("invalid rate '%s'", rate)
+	}
+
+	return int64(value * float64(unit)), nil
+}
+
+// parseTimeOfDay parses a time of the day like "22:30" into the duration since midnight
+func parseTimeOfDay(value string) (time.Duration, error) {
+	parsed, err := time.Parse("15:04", value)
+	if err != nil {
+		return 0, errors.Wrapf(err, "can't parse time of the day '%s'", value)
+	}
+
+	return time.Duration(parsed.Hour())*time.Hour + time.Duration(parsed.Minute())*time.Minute, nil
+}
+
+// Deletions represents how many files can be deleted within a time window before
+// a direction of the synchronization is paused. A negative count or percent
+// disables its check
+type Deletions struct {
+	MaxCount   int    `toml:"max_count"`
+	MaxPercent int    `toml:"max_percent"`
+	Window     string `toml:"window"`
+}
+
+// Limit returns the deletion limit, using the default values for missing fields
+func (d Deletions) Limit() (sync.DeletionLimit, error) {
+	limit := sync.DefaultDeletionLimit
+
+	if d.MaxCount != 0 {
+		limit.Count = d.MaxCount
+	}
+
+	if d.MaxPercent != 0 {
+		limit.Percent = d.MaxPercent
+	}
+
+	if d.Window != "" {
+		window, err := time.ParseDuration(d.Window)
+		if err != nil {
+			return limit, errors.Wrap(err, "can't parse deletions window")
+		}
+		limit.Window = window
+	}
+
+	return limit, nil
+}
+
+// Transfers represents how many files of a folder are uploaded and downloaded at
+// the same time
+type Transfers struct {
+	Downloads int `toml:"downloads"`
+	Uploads   int `toml:"uploads"`
+}
+
+// Parallel returns the number of simultaneous transfers, using the default values
+// for missing fields
+func (t Transfers) Parallel() sync.Transfers {
+	transfers := sync.DefaultTransfers
+
+	if t.Downloads > 0 {
+		transfers.Downloads = t.Downloads
+	}
+
+	if t.Uploads > 0 {
+		transfers.Uploads = t.Uploads
+	}
+
+	return transfers
+}
+
+// Trash represents how long the local files removed or overwritten by the
+// synchronizer are kept, like "720h". "0" keeps them forever
+type Trash struct {
+	Retention string `toml:"retention"`
+}
+
+// RetentionPeriod returns how long files are kept in the trash, using the default
+// value when missing. Zero means forever
+func (t Trash) RetentionPeriod() (time.Duration, error) {
+	if t.Retention == "" {
+		return local.DefaultTrashRetention, nil
+	}
+
+	retention, err := time.ParseDuration(t.Retention)
+	if err != nil {
+		return 0, errors.Wrap(err, "can't parse trash retention")
+	}
+
+	return retention, nil
+}
+
+// FolderOf returns the folder holding a local path
+func (c *Config) FolderOf(localPath string) (Folder, bool) {
+	for _, folder := range c.Folders {
+		folderPath := filepath.Clean(folder.LocalPath)
+		if localPath == folderPath || strings.HasPrefix(localPath, folderPath+"/") {
+			return folder, true
+		}
+	}
+
+	return Folder{}, false
+}
+
+// Folder represents a folder to synchronize. Bandwidth limits its transfers on
+// top of the global limits. Exclude lists gitignore-style patterns of paths
+// never synchronized, on top of the .dropboxignore files. Mode
+// is one of "sync", "backup", "download" or "mirror", whose authoritative side is
+// given by MirrorSource, either "dropbox" or "local"
 type Folder struct {
-	RemotePath string `toml:"remote_path"`
-	LocalPath  string `toml:"local_path"`
+	Bandwidth     Bandwidth     `toml:"bandwidth"`
+	Exclude       []string      `toml:"exclude"`
+	MirrorSource  string        `toml:"mirror_source"`
+	Mode          string        `toml:"mode"`
+	RemotePath    string        `toml:"remote_path"`
+	LocalPath     string        `toml:"local_path"`
+	SelectiveSync SelectiveSync `toml:"selective_sync"`
+}
+
+// SyncMode returns the synchronization mode of the folder, bidirectional by default
+func (f Folder) SyncMode() (sync.Mode, error) {
+	switch f.Mode {
+	case "", "sync":
+		return sync.ModeSync, nil
+	case "backup":
+		return sync.ModeBackup, nil
+	case "download":
+		return sync.ModeDownload, nil
+	case "mirror":
+		switch f.MirrorSource {
+		case "dropbox":
+			return sync.ModeMirrorDropbox, nil
+		case "local":
+			return sync.ModeMirrorLocal, nil
+		default:
+			return "", errors.Errorf("mirror_source of folder '%s' must be \"dropbox\" or \"local\"", f.RemotePath)
+		}
+	default:
+		return "", errors.Errorf("unknown mode '%s' of folder '%s'", f.Mode, f.RemotePath)
+	}
+}
+
+// SelectiveSync represents the Dropbox subfolders to synchronize, relative to the
+// remote path. Everything is synchronized when no subfolder is included
+type SelectiveSync struct {
+	Include []string `toml:"include"`
+	Exclude []string `toml:"exclude"`
+}
+
+// Matcher returns the ignore rules of the folder
+func (f Folder) Matcher() (*ignore.Matcher, error) {
+	selection := ignore.NewSelection(f.SelectiveSync.Include, f.SelectiveSync.Exclude)
+
+	return ignore.NewMatcher(f.LocalPath, f.Exclude, selection)
+}
+
+// Key returns a stable identifier of the folder, used to name its state files
+func (f Folder) Key() string {
+	return fmt.Sprintf("%x", sha1.Sum([]byte(f.RemotePath+"\x00"+f.LocalPath)))
 }
 
 // LoadConfiguration load the configuration from the home folder
@@ -55,7 +396,10 @@ func LoadConfiguration() (*Config, error) {
 		if err != nil {
 			return nil, errors.Wrap(err, "can't expand local path")
 		}
-		config.Folders[i].LocalPath = localPath
+		// paths are compared with the ones of the watched files and of Dropbox, which
+		// never end with a slash
+		config.Folders[i].LocalPath = filepath.Clean(localPath)
+		config.Folders[i].RemotePath = strings.TrimRight(folder.RemotePath, "/")
 	}
 
 	return config, nil
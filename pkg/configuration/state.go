@@ -0,0 +1,53 @@
+package configuration
+
+import (
+	"path"
+
+	"github.com/kdisneur/dropbox_sync/pkg/local"
+	"github.com/kdisneur/dropbox_sync/pkg/state"
+	homedir "github.com/mitchellh/go-homedir"
+	"github.com/pkg/errors"
+)
+
+var stateFolderPath = path.Join("~", ".config", "dropbox_sync", "state")
+
+// PauseFolder returns the folder holding the pause files of a folder whose
+// synchronization deleted too many files
+func PauseFolder(folder Folder) (string, error) {
+	folderPath, err := homedir.Expand(stateFolderPath)
+	if err != nil {
+		return "", errors.Wrap(err, "can't find HOME folder")
+	}
+
+	return path.Join(folderPath, folder.Key()+".paused"), nil
+}
+
+// OpenState opens the synchronization state of a folder
+func OpenState(folder Folder) (*state.Store, error) {
+	folderPath, err := homedir.Expand(stateFolderPath)
+	if err != nil {
+		return nil, errors.Wrap(err, "can't find HOME folder")
+	}
+
+	store, err := state.Open(path.Join(folderPath, folder.Key()+".db"))
+	if err != nil {
+		return nil, errors.Wrapf(err, "can't open state of folder '%s'", folder.RemotePath)
+	}
+
+	return store, nil
+}
+
+// OpenHashCache opens the content hashes of the local files, shared by every folder
+func OpenHashCache() (*local.HashCache, error) {
+	folderPath, err := homedir.Expand(stateFolderPath)
+	if err != nil {
+		return nil, errors.Wrap(err, "can't find HOME folder")
+	}
+
+	hashes, err := local.OpenHashCache(path.Join(folderPath, "hashes.db"))
+	if err != nil {
+		return nil, errors.Wrap(err, "can't open hash cache")
+	}
+
+	return hashes, nil
+}
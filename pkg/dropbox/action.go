@@ -10,10 +10,14 @@ const (
 
 	// ActionTypeDelete represents a new file or folder deletion
 	ActionTypeDelete internal.ActionType = "delete"
+
+	// ActionTypeMove represents a file or folder moved from `Source` to `File`
+	ActionTypeMove internal.ActionType = "move"
 )
 
 // Action represents a Dropbox action
 type Action struct {
-	Type internal.ActionType
-	File File
+	Type   internal.ActionType
+	File   File
+	Source File
 }
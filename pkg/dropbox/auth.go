@@ -0,0 +1,19 @@
+package dropbox
+
+import (
+	"context"
+
+	"github.com/kdisneur/dropbox_sync/pkg/dropbox/internal"
+)
+
+// TokenRevoke disables the access token of the client and its refresh token
+func TokenRevoke(ctx context.Context, client Client) error {
+	_, err := internal.POSTWithBody(
+		ctx,
+		client.session(),
+		client.Endpoints.api("/2/auth/token/revoke"),
+		nil,
+	)
+
+	return err
+}
@@ -0,0 +1,66 @@
+package dropbox
+
+import (
+	"time"
+
+	"github.com/kdisneur/dropbox_sync/pkg/dropbox/internal"
+)
+
+// BandwidthLimit represents the bytes per second allowed in each direction. Zero
+// is unlimited
+type BandwidthLimit struct {
+	Download int64
+	Upload   int64
+}
+
+// BandwidthPeriod represents limits applied every day from a time of the day,
+// included, to another, excluded. A period ending before it starts spans midnight
+type BandwidthPeriod struct {
+	From  time.Duration
+	Limit BandwidthLimit
+	To    time.Duration
+}
+
+// BandwidthSchedule represents the limits over the day. The first period
+// including the current time of the day wins over the default limit
+type BandwidthSchedule struct {
+	Limit   BandwidthLimit
+	Periods []BandwidthPeriod
+}
+
+// At returns the limits applied at a given time
+func (s BandwidthSchedule) At(at time.Time) BandwidthLimit {
+	midnight := time.Date(at.Year(), at.Month(), at.Day(), 0, 0, 0, 0, at.Location())
+	timeOfDay := at.Sub(midnight)
+
+	for _, period := range s.Periods {
+		if period.includes(timeOfDay) {
+			return period.Limit
+		}
+	}
+
+	return s.Limit
+}
+
+func (p BandwidthPeriod) includes(timeOfDay time.Duration) bool {
+	if p.From <= p.To {
+		return timeOfDay >= p.From && timeOfDay < p.To
+	}
+
+	return timeOfDay >= p.From || timeOfDay < p.To
+}
+
+// BandwidthLimiter limits the transfers of every client using it, so several
+// clients can share the same limits
+type BandwidthLimiter struct {
+	download *internal.Bucket
+	upload   *internal.Bucket
+}
+
+// NewBandwidthLimiter creates a limiter following a schedule
+func NewBandwidthLimiter(schedule BandwidthSchedule) *BandwidthLimiter {
+	return &BandwidthLimiter{
+		download: internal.NewBucket(func() int64 { return schedule.At(time.Now()).Download }),
+		upload:   internal.NewBucket(func() int64 { return schedule.At(time.Now()).Upload }),
+	}
+}
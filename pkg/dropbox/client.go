@@ -1,11 +1,111 @@
 package dropbox
 
-// Client represents an authenticated user
+import (
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/kdisneur/dropbox_sync/pkg/dropbox/internal"
+)
+
+// RetryPolicy represents how many times and how often a failed request is sent
+// again. Only network errors, rate limiting and server errors are retried.
+// Uploads, moves and deletions are only sent again when the failed attempt
+// provably wasn't processed, so they never happen twice
+type RetryPolicy struct {
+	InitialBackoff time.Duration
+	MaxAttempts    int
+	MaxBackoff     time.Duration
+}
+
+// DefaultRetryPolicy is the retry policy of a new client
+var DefaultRetryPolicy = RetryPolicy{
+	InitialBackoff: time.Second,
+	MaxAttempts:    5,
+	MaxBackoff:     time.Minute,
+}
+
+// Endpoints represents the base URLs of the Dropbox API. They can point to a
+// proxy gateway or to a local stand-in for tests
+type Endpoints struct {
+	API     string
+	Content string
+	Notify  string
+}
+
+// DefaultEndpoints are the base URLs of the real Dropbox API
+var DefaultEndpoints = Endpoints{
+	API:     "https://api.dropboxapi.com",
+	Content: "https://content.dropboxapi.com",
+	Notify:  "https://notify.dropboxapi.com",
+}
+
+// Client represents an authenticated user. Its copies share the same access token
 type Client struct {
-	token string
+	Endpoints  Endpoints
+	HTTPClient *http.Client
+	// Limiters all limit the bytes sent and received by the client
+	Limiters    []*BandwidthLimiter
+	RetryPolicy RetryPolicy
+	tokens      *tokenSource
 }
 
-// NewClient creates a new Dropbox client from a token
+// NewClient creates a new Dropbox client from an access token which is never renewed
 func NewClient(token string) Client {
-	return Client{token: token}
+	return newClient(&tokenSource{token: Token{AccessToken: token}})
+}
+
+// NewRefreshingClient creates a new Dropbox client renewing its access token with
+// the refresh token when it expires. Renewed tokens are given to `save`, when not
+// nil, so they can be reused later
+func NewRefreshingClient(oauth2 OAuth2, token Token, save func(Token) error) Client {
+	return newClient(&tokenSource{oauth2: oauth2, save: save, token: token})
+}
+
+func newClient(tokens *tokenSource) Client {
+	return Client{
+		Endpoints:   DefaultEndpoints,
+		HTTPClient:  http.DefaultClient,
+		RetryPolicy: DefaultRetryPolicy,
+		tokens:      tokens,
+	}
+}
+
+func (c Client) session() internal.Session {
+	session := internal.Session{
+		HTTPClient: c.HTTPClient,
+		Retry:      internal.RetryPolicy(c.RetryPolicy),
+	}
+
+	if c.tokens != nil {
+		session.Tokens = c.tokens
+	}
+
+	for _, limiter := range c.Limiters {
+		session.Download = append(session.Download, limiter.download)
+		session.Upload = append(session.Upload, limiter.upload)
+	}
+
+	return session
+}
+
+// notIdempotentSession returns the session of requests which must not be
+// processed twice, like uploads, moves and deletions
+func (c Client) notIdempotentSession() internal.Session {
+	session := c.session()
+	session.NotIdempotent = true
+
+	return session
+}
+
+func (e Endpoints) api(path string) string {
+	return strings.TrimSuffix(e.API, "/") + path
+}
+
+func (e Endpoints) content(path string) string {
+	return strings.TrimSuffix(e.Content, "/") + path
+}
+
+func (e Endpoints) notify(path string) string {
+	return strings.TrimSuffix(e.Notify, "/") + path
 }
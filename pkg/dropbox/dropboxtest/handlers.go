@@ -0,0 +1,498 @@
+package dropboxtest
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/kdisneur/dropbox_sync/pkg/dropbox/internal"
+)
+
+// download represents a file content sent back with its metadata in a header
+type download struct {
+	content  []byte
+	metadata internal.FileMetadataResponse
+}
+
+type pathArgument struct {
+	Path string `json:"path"`
+}
+
+type commitArgument struct {
+	Autorename bool            `json:"autorename"`
+	Path       string          `json:"path"`
+	Mode       json.RawMessage `json:"mode"`
+}
+
+type uploadCursorArgument struct {
+	SessionID string `json:"session_id"`
+	Offset    int64  `json:"offset"`
+}
+
+// route registers an endpoint. Handlers return the value to send back as JSON, a
+// download, or an error
+func (s *Server) route(mux *http.ServeMux, pattern string, authenticated bool, handle func(*http.Request) (interface{}, error)) {
+	mux.HandleFunc(pattern, func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "only POST requests are supported", http.StatusMethodNotAllowed)
+			return
+		}
+
+		if authenticated {
+			f := s.authenticate(r)
+			if f != nil {
+				writeFailure(w, f)
+				return
+			}
+		}
+
+		response, err := handle(r)
+		if err != nil {
+			f, ok := err.(*failure)
+			if !ok {
+				f = &failure{status: http.StatusBadRequest, summary: err.Error()}
+			}
+
+			writeFailure(w, f)
+			return
+		}
+
+		if file, ok := response.(download); ok {
+			metadata, err := json.Marshal(file.metadata)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+
+			w.Header().Set("Content-Type", "application/octet-stream")
+			w.Header().Set("Dropbox-API-Result", string(metadata))
+			w.Write(file.content)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(response)
+	})
+}
+
+// authenticate returns why the access token of a request is rejected
+func (s *Server) authenticate(r *http.Request) *failure {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if s.expired[token] {
+		return &failure{status: http.StatusUnauthorized, summary: "expired_access_token/.."}
+	}
+
+	if token != s.token {
+		return &failure{status: http.StatusUnauthorized, summary: "invalid_access_token/.."}
+	}
+
+	return nil
+}
+
+func writeFailure(w http.ResponseWriter, f *failure) {
+	if f.status == http.StatusBadRequest {
+		http.Error(w, f.summary, f.status)
+		return
+	}
+
+	details := f.details
+	if details == nil {
+		details = map[string]interface{}{".tag": strings.SplitN(f.summary, "/", 2)[0]}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(f.status)
+	json.NewEncoder(w).Encode(map[string]interface{}{"error_summary": f.summary, "error": details})
+}
+
+func decodeBody(r *http.Request, argument interface{}) error {
+	return json.NewDecoder(r.Body).Decode(argument)
+}
+
+func decodeHeader(r *http.Request, argument interface{}) error {
+	return json.Unmarshal([]byte(r.Header.Get("Dropbox-API-Arg")), argument)
+}
+
+func decodeWriteMode(raw json.RawMessage) (writeMode, error) {
+	if len(raw) == 0 {
+		return writeMode{tag: "add"}, nil
+	}
+
+	var tag string
+	if json.Unmarshal(raw, &tag) == nil {
+		return writeMode{tag: tag}, nil
+	}
+
+	var update struct {
+		Tag    string `json:".tag"`
+		Update string `json:"update"`
+	}
+
+	err := json.Unmarshal(raw, &update)
+
+	return writeMode{tag: update.Tag, rev: update.Update}, err
+}
+
+func (s *Server) handleCreateFolder(r *http.Request) (interface{}, error) {
+	var argument pathArgument
+	err := decodeBody(r, &argument)
+	if err != nil {
+		return nil, err
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	created, err := s.createFolder(argument.Path)
+	if err != nil {
+		return nil, err
+	}
+
+	return internal.RelocationResponse{Metadata: created.metadata}, nil
+}
+
+func (s *Server) handleDelete(r *http.Request) (interface{}, error) {
+	var argument pathArgument
+	err := decodeBody(r, &argument)
+	if err != nil {
+		return nil, err
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	removed, err := s.remove(argument.Path)
+	if err != nil {
+		return nil, err
+	}
+
+	return internal.RelocationResponse{Metadata: removed.metadata}, nil
+}
+
+func (s *Server) handleDownload(r *http.Request) (interface{}, error) {
+	var argument pathArgument
+	err := decodeHeader(r, &argument)
+	if err != nil {
+		return nil, err
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	file, err := s.lookupFile(argument.Path)
+	if err != nil {
+		return nil, err
+	}
+
+	if s.restricted[key(argument.Path)] {
+		return nil, conflict("path/restricted_content/..")
+	}
+
+	return download{content: file.content, metadata: file.metadata}, nil
+}
+
+func (s *Server) handleGetMetadata(r *http.Request) (interface{}, error) {
+	var argument pathArgument
+	err := decodeBody(r, &argument)
+	if err != nil {
+		return nil, err
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	stored, ok := s.entries[key(argument.Path)]
+	if !ok {
+		return nil, conflict("path/not_found/..")
+	}
+
+	return stored.metadata, nil
+}
+
+func (s *Server) handleListFolder(r *http.Request) (interface{}, error) {
+	var argument pathArgument
+	err := decodeBody(r, &argument)
+	if err != nil {
+		return nil, err
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	listing, err := s.startListing(argument.Path)
+	if err != nil {
+		return nil, err
+	}
+
+	return s.page(listing), nil
+}
+
+func (s *Server) handleListFolderContinue(r *http.Request) (interface{}, error) {
+	var argument struct {
+		Cursor string `json:"cursor"`
+	}
+
+	err := decodeBody(r, &argument)
+	if err != nil {
+		return nil, err
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	next, err := s.continueListing(argument.Cursor)
+	if err != nil {
+		return nil, err
+	}
+
+	return s.page(next), nil
+}
+
+// handleLongPoll waits until changes are available for a cursor or the timeout expires
+func (s *Server) handleLongPoll(r *http.Request) (interface{}, error) {
+	var argument struct {
+		Cursor  string `json:"cursor"`
+		Timeout int    `json:"timeout"`
+	}
+
+	err := decodeBody(r, &argument)
+	if err != nil {
+		return nil, err
+	}
+
+	if argument.Timeout <= 0 {
+		argument.Timeout = 30
+	}
+
+	timer := time.NewTimer(time.Duration(argument.Timeout) * time.Second)
+	defer timer.Stop()
+
+	for {
+		s.mutex.Lock()
+		next, err := s.continueListing(argument.Cursor)
+		changed := s.changed
+		s.mutex.Unlock()
+
+		if err != nil {
+			return nil, err
+		}
+
+		if len(next.pending) > 0 {
+			return internal.LongPollResponse{NewFilesAvailable: true}, nil
+		}
+
+		select {
+		case <-changed:
+		case <-timer.C:
+			return internal.LongPollResponse{NewFilesAvailable: false}, nil
+		case <-s.done:
+			return internal.LongPollResponse{NewFilesAvailable: false}, nil
+		case <-r.Context().Done():
+			return nil, r.Context().Err()
+		}
+	}
+}
+
+func (s *Server) handleMove(r *http.Request) (interface{}, error) {
+	var argument struct {
+		FromPath string `json:"from_path"`
+		ToPath   string `json:"to_path"`
+	}
+
+	err := decodeBody(r, &argument)
+	if err != nil {
+		return nil, err
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	moved, err := s.move(argument.FromPath, argument.ToPath)
+	if err != nil {
+		return nil, err
+	}
+
+	return internal.RelocationResponse{Metadata: moved.metadata}, nil
+}
+
+// handleToken exchanges any authorization code sent with a PKCE code verifier, or
+// the refresh token, for a new access token
+func (s *Server) handleToken(r *http.Request) (interface{}, error) {
+	err := r.ParseForm()
+	if err != nil {
+		return nil, err
+	}
+
+	response := internal.AccessTokenResponse{ExpiresIn: 4 * 60 * 60}
+	switch r.PostForm.Get("grant_type") {
+	case "authorization_code":
+		if r.PostForm.Get("code") == "" || r.PostForm.Get("code_verifier") == "" {
+			return nil, &failure{status: http.StatusBadRequest, summary: "invalid_grant"}
+		}
+		response.RefreshToken = s.RefreshToken
+	case "refresh_token":
+		if r.PostForm.Get("refresh_token") != s.RefreshToken {
+			return nil, &failure{status: http.StatusBadRequest, summary: "invalid_grant"}
+		}
+	default:
+		return nil, &failure{status: http.StatusBadRequest, summary: "unsupported_grant_type"}
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.lastToken++
+	s.token = fmt.Sprintf("%s-%d", DefaultToken, s.lastToken)
+	response.Token = s.token
+
+	return response, nil
+}
+
+// handleRevoke disables the current access token until a new one is issued
+func (s *Server) handleRevoke(r *http.Request) (interface{}, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.token = ""
+
+	return nil, nil
+}
+
+func (s *Server) handleUpload(r *http.Request) (interface{}, error) {
+	var argument commitArgument
+	err := decodeHeader(r, &argument)
+	if err != nil {
+		return nil, err
+	}
+
+	content, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	return s.commit(argument, content)
+}
+
+func (s *Server) handleUploadSessionStart(r *http.Request) (interface{}, error) {
+	content, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.lastUpload++
+	sessionID := fmt.Sprintf("session-%d", s.lastUpload)
+	s.uploads[sessionID] = content
+
+	return internal.UploadSessionStartResponse{SessionID: sessionID}, nil
+}
+
+func (s *Server) handleUploadSessionAppend(r *http.Request) (interface{}, error) {
+	var argument struct {
+		Cursor uploadCursorArgument `json:"cursor"`
+	}
+
+	err := decodeHeader(r, &argument)
+	if err != nil {
+		return nil, err
+	}
+
+	content, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	lookup := s.lookupUpload(argument.Cursor)
+	if lookup != nil {
+		return nil, &failure{
+			details: lookup,
+			status:  http.StatusConflict,
+			summary: lookup.Tag + "/..",
+		}
+	}
+
+	s.uploads[argument.Cursor.SessionID] = append(s.uploads[argument.Cursor.SessionID], content...)
+
+	return struct{}{}, nil
+}
+
+func (s *Server) handleUploadSessionFinish(r *http.Request) (interface{}, error) {
+	var argument struct {
+		Cursor uploadCursorArgument `json:"cursor"`
+		Commit commitArgument       `json:"commit"`
+	}
+
+	err := decodeHeader(r, &argument)
+	if err != nil {
+		return nil, err
+	}
+
+	content, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	s.mutex.Lock()
+	lookup := s.lookupUpload(argument.Cursor)
+	if lookup != nil {
+		s.mutex.Unlock()
+
+		return nil, &failure{
+			details: map[string]interface{}{".tag": "lookup_failed", "lookup_failed": lookup},
+			status:  http.StatusConflict,
+			summary: "lookup_failed/" + lookup.Tag + "/..",
+		}
+	}
+
+	content = append(s.uploads[argument.Cursor.SessionID], content...)
+	delete(s.uploads, argument.Cursor.SessionID)
+	s.mutex.Unlock()
+
+	return s.commit(argument.Commit, content)
+}
+
+// lookupUpload returns why an upload session can't receive data at the given offset
+func (s *Server) lookupUpload(uploadCursor uploadCursorArgument) *internal.UploadSessionLookupError {
+	received, ok := s.uploads[uploadCursor.SessionID]
+	if !ok {
+		return &internal.UploadSessionLookupError{Tag: "not_found"}
+	}
+
+	if uploadCursor.Offset != int64(len(received)) {
+		return &internal.UploadSessionLookupError{Tag: "incorrect_offset", CorrectOffset: int64(len(received))}
+	}
+
+	return nil
+}
+
+func (s *Server) commit(argument commitArgument, content []byte) (interface{}, error) {
+	mode, err := decodeWriteMode(argument.Mode)
+	if err != nil {
+		return nil, err
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	written, err := s.writeFile(argument.Path, content, mode)
+	for i := 1; argument.Autorename && isWriteConflict(err); i++ {
+		written, err = s.writeFile(renamed(argument.Path, i), content, mode)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	return written.metadata, nil
+}
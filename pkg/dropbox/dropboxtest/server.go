@@ -0,0 +1,254 @@
+package dropboxtest
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/kdisneur/dropbox_sync/pkg/dropbox"
+	"github.com/kdisneur/dropbox_sync/pkg/dropbox/internal"
+)
+
+// DefaultToken is the access token accepted by a new server
+const DefaultToken = "dropboxtest-token"
+
+// DefaultRefreshToken is the refresh token accepted by a new server
+const DefaultRefreshToken = "dropboxtest-refresh-token"
+
+// DefaultPageSize is the maximum number of entries in a listing page of a new server
+const DefaultPageSize = 100
+
+// Server represents an in-process fake Dropbox keeping its files in memory. It
+// implements the endpoints used by the dropbox package so a synchronization can
+// run end to end without network access. Listings are always recursive
+type Server struct {
+	// PageSize is the maximum number of entries in a listing page. It must be set
+	// before the first request
+	PageSize int
+	// RefreshToken is the refresh token expected from clients renewing their access
+	// token. It must be set before the first request
+	RefreshToken string
+
+	changed    chan struct{}
+	cursors    map[string]cursor
+	done       chan struct{}
+	entries    map[string]*entry
+	expired    map[string]bool
+	journal    []internal.FileMetadataResponse
+	lastCursor int
+	lastID     int
+	lastRev    int
+	lastToken  int
+	lastUpload int
+	mutex      sync.Mutex
+	restricted map[string]bool
+	server     *httptest.Server
+	token      string
+	uploads    map[string][]byte
+}
+
+// entry represents a file or a folder stored by the server
+type entry struct {
+	content  []byte
+	metadata internal.FileMetadataResponse
+}
+
+// cursor represents a position in the server journal, with the entries of the
+// current listing not sent yet
+type cursor struct {
+	path     string
+	pending  []internal.FileMetadataResponse
+	position int
+}
+
+// NewServer starts a fake Dropbox server with an empty tree
+func NewServer() *Server {
+	s := &Server{
+		PageSize:     DefaultPageSize,
+		RefreshToken: DefaultRefreshToken,
+		changed:      make(chan struct{}),
+		cursors:      make(map[string]cursor),
+		done:         make(chan struct{}),
+		entries:      make(map[string]*entry),
+		expired:      make(map[string]bool),
+		restricted:   make(map[string]bool),
+		token:        DefaultToken,
+		uploads:      make(map[string][]byte),
+	}
+
+	mux := http.NewServeMux()
+	s.route(mux, "/2/auth/token/revoke", true, s.handleRevoke)
+	s.route(mux, "/2/files/create_folder_v2", true, s.handleCreateFolder)
+	s.route(mux, "/2/files/delete_v2", true, s.handleDelete)
+	s.route(mux, "/2/files/download", true, s.handleDownload)
+	s.route(mux, "/2/files/get_metadata", true, s.handleGetMetadata)
+	s.route(mux, "/2/files/list_folder", true, s.handleListFolder)
+	s.route(mux, "/2/files/list_folder/continue", true, s.handleListFolderContinue)
+	s.route(mux, "/2/files/list_folder/longpoll", false, s.handleLongPoll)
+	s.route(mux, "/2/files/move_v2", true, s.handleMove)
+	s.route(mux, "/2/files/upload", true, s.handleUpload)
+	s.route(mux, "/2/files/upload_session/append_v2", true, s.handleUploadSessionAppend)
+	s.route(mux, "/2/files/upload_session/finish", true, s.handleUploadSessionFinish)
+	s.route(mux, "/2/files/upload_session/start", true, s.handleUploadSessionStart)
+	s.route(mux, "/oauth2/token", false, s.handleToken)
+
+	s.server = httptest.NewServer(mux)
+
+	return s
+}
+
+// Close stops the server, releasing the pending long polls
+func (s *Server) Close() {
+	close(s.done)
+	s.server.Close()
+}
+
+// URL returns the base URL of the server
+func (s *Server) URL() string {
+	return s.server.URL
+}
+
+// Endpoints returns the Dropbox endpoints pointing to the server
+func (s *Server) Endpoints() dropbox.Endpoints {
+	return dropbox.Endpoints{API: s.server.URL, Content: s.server.URL, Notify: s.server.URL}
+}
+
+// OAuth2 returns the OAuth2 configuration renewing access tokens with the server
+func (s *Server) OAuth2() dropbox.OAuth2 {
+	oauth2 := dropbox.NewOAuth2("dropboxtest", "")
+	oauth2.API = s.server.URL
+	oauth2.HTTPClient = s.server.Client()
+
+	return oauth2
+}
+
+// Token returns the access token currently accepted by the server
+func (s *Server) Token() string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return s.token
+}
+
+// ExpireToken rejects the current access token as expired until clients renew it
+// with the refresh token
+func (s *Server) ExpireToken() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.expired[s.token] = true
+}
+
+// Client returns a Dropbox client authenticated against the server, renewing its
+// access token when it expires. Failed requests are sent again without waiting long
+func (s *Server) Client() dropbox.Client {
+	token := dropbox.Token{AccessToken: s.Token(), RefreshToken: s.RefreshToken}
+
+	client := dropbox.NewRefreshingClient(s.OAuth2(), token, nil)
+	client.Endpoints = s.Endpoints()
+	client.HTTPClient = s.server.Client()
+	client.RetryPolicy = dropbox.RetryPolicy{
+		InitialBackoff: 10 * time.Millisecond,
+		MaxAttempts:    3,
+		MaxBackoff:     100 * time.Millisecond,
+	}
+
+	return client
+}
+
+// WriteFile creates or overwrites a file, like another Dropbox client would
+func (s *Server) WriteFile(filePath string, content []byte) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	_, err := s.writeFile(filePath, content, writeMode{tag: "overwrite"})
+
+	return err
+}
+
+// CreateFolder creates a folder, like another Dropbox client would
+func (s *Server) CreateFolder(folderPath string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	_, err := s.createFolder(folderPath)
+
+	return err
+}
+
+// Remove deletes a file or a folder with everything it contains, like another
+// Dropbox client would
+func (s *Server) Remove(filePath string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	_, err := s.remove(filePath)
+
+	return err
+}
+
+// Move renames a file or a folder, like another Dropbox client would
+func (s *Server) Move(fromPath string, toPath string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	_, err := s.move(fromPath, toPath)
+
+	return err
+}
+
+// RestrictContent makes the downloads of a file fail, like Dropbox does for content
+// it blocked, until AllowContent is called
+func (s *Server) RestrictContent(filePath string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.restricted[key(filePath)] = true
+}
+
+// AllowContent makes a restricted file downloadable again
+func (s *Server) AllowContent(filePath string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	delete(s.restricted, key(filePath))
+}
+
+// ReadFile returns the content of a file
+func (s *Server) ReadFile(filePath string) ([]byte, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	file, err := s.lookupFile(filePath)
+	if err != nil {
+		return nil, err
+	}
+
+	return file.content, nil
+}
+
+// Paths returns the path of every file and folder stored, sorted
+func (s *Server) Paths() []string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	paths := make([]string, 0, len(s.entries))
+	for _, stored := range s.entries {
+		paths = append(paths, stored.metadata.Path)
+	}
+
+	sort.Strings(paths)
+
+	return paths
+}
+
+// ResetCursors invalidates every cursor handed out, like Dropbox does from time
+// to time. Clients have to list their folder again from scratch
+func (s *Server) ResetCursors() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.cursors = make(map[string]cursor)
+}
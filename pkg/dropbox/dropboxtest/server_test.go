@@ -0,0 +1,206 @@
+package dropboxtest_test
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/kdisneur/dropbox_sync/pkg/dropbox"
+	"github.com/kdisneur/dropbox_sync/pkg/dropbox/dropboxtest"
+	"github.com/sirupsen/logrus"
+)
+
+func TestUploadAndDownload(t *testing.T) {
+	srv := dropboxtest.NewServer()
+	defer srv.Close()
+
+	ctx := context.Background()
+	client := srv.Client()
+
+	mode := dropbox.WriteModeAdd
+	for _, size := range []int{0, 10, dropbox.UploadChunkSize + 10} {
+		content := bytes.Repeat([]byte("a"), size)
+
+		uploaded, err := dropbox.FileUploadStream(ctx, client, "/folder/file.txt", bytes.NewReader(content), mode)
+		if err != nil {
+			t.Fatalf("can't upload %d bytes: %s", size, err)
+		}
+		mode = dropbox.WriteModeUpdate(uploaded.Rev)
+
+		var downloaded bytes.Buffer
+		file, err := dropbox.FileDownloadTo(ctx, client, "/folder/file.txt", &downloaded)
+		if err != nil {
+			t.Fatalf("can't download %d bytes: %s", size, err)
+		}
+
+		if !bytes.Equal(downloaded.Bytes(), content) {
+			t.Fatalf("expected %d bytes downloaded, got %d", size, downloaded.Len())
+		}
+
+		if file.Rev != uploaded.Rev || file.ContentHash != uploaded.ContentHash {
+			t.Fatalf("expected downloaded metadata %+v, got %+v", uploaded, file)
+		}
+	}
+
+	if paths := srv.Paths(); !reflect.DeepEqual(paths, []string{"/folder", "/folder/file.txt"}) {
+		t.Fatalf("expected the parent folder to be created, got %v", paths)
+	}
+}
+
+func TestWriteModes(t *testing.T) {
+	srv := dropboxtest.NewServer()
+	defer srv.Close()
+
+	ctx := context.Background()
+	client := srv.Client()
+
+	first, err := dropbox.FileUpload(ctx, client, "/file.txt", []byte("first"), dropbox.WriteModeAdd)
+	if err != nil {
+		t.Fatalf("can't add file: %s", err)
+	}
+
+	_, err = dropbox.FileUpload(ctx, client, "/file.txt", []byte("first"), dropbox.WriteModeAdd)
+	if err != nil {
+		t.Fatalf("expected adding the same content to succeed, got %s", err)
+	}
+
+	_, err = dropbox.FileUpload(ctx, client, "/file.txt", []byte("other"), dropbox.WriteModeAdd)
+	if !dropbox.IsConflict(err) {
+		t.Fatalf("expected a conflict when adding over another content, got %v", err)
+	}
+
+	renamed, err := dropbox.FileUpload(ctx, client, "/file.txt", []byte("other"), dropbox.WriteModeAddRenamed)
+	if err != nil || renamed.RemotePath != "/file (1).txt" {
+		t.Fatalf("expected the file to be renamed to '/file (1).txt', got %v (%v)", renamed, err)
+	}
+
+	second, err := dropbox.FileUpload(ctx, client, "/file.txt", []byte("second"), dropbox.WriteModeUpdate(first.Rev))
+	if err != nil {
+		t.Fatalf("can't update file: %s", err)
+	}
+
+	_, err = dropbox.FileUpload(ctx, client, "/file.txt", []byte("third"), dropbox.WriteModeUpdate(first.Rev))
+	if !dropbox.IsConflict(err) {
+		t.Fatalf("expected a conflict when updating an outdated revision, got %v", err)
+	}
+
+	if second.ID != first.ID || second.Rev == first.Rev {
+		t.Fatalf("expected the same id and a new revision, got %+v then %+v", first, second)
+	}
+}
+
+func TestMoveAndDelete(t *testing.T) {
+	srv := dropboxtest.NewServer()
+	defer srv.Close()
+
+	ctx := context.Background()
+	client := srv.Client()
+
+	srv.WriteFile("/from/file.txt", []byte("content"))
+
+	moved, err := dropbox.FileMove(ctx, client, "/from", "/to")
+	if err != nil {
+		t.Fatalf("can't move folder: %s", err)
+	}
+
+	if moved.Type != dropbox.FileTypeFolder || moved.RemotePath != "/to" {
+		t.Fatalf("expected the moved folder metadata, got %+v", moved)
+	}
+
+	content, err := srv.ReadFile("/to/file.txt")
+	if err != nil || string(content) != "content" {
+		t.Fatalf("expected the file to be moved with its folder, got %q (%v)", content, err)
+	}
+
+	_, err = dropbox.FileMetadata(ctx, client, "/from/file.txt")
+	if !dropbox.IsNotFound(err) {
+		t.Fatalf("expected the source to be missing, got %v", err)
+	}
+
+	err = dropbox.FileDelete(ctx, client, "/to")
+	if err != nil {
+		t.Fatalf("can't delete folder: %s", err)
+	}
+
+	if paths := srv.Paths(); len(paths) != 0 {
+		t.Fatalf("expected an empty tree, got %v", paths)
+	}
+}
+
+func TestListingAndChanges(t *testing.T) {
+	srv := dropboxtest.NewServer()
+	defer srv.Close()
+
+	srv.PageSize = 2
+	for _, filePath := range []string{"/root/a.txt", "/root/b.txt", "/root/c/d.txt"} {
+		srv.WriteFile(filePath, []byte(filePath))
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	scanner := dropbox.NewScanner(discardLogger(), srv.Client(), "/root", nil, nil)
+
+	files, err := scanner.InitialListing(ctx)
+	if err != nil {
+		t.Fatalf("can't list folder: %s", err)
+	}
+
+	var paths []string
+	for _, file := range files {
+		paths = append(paths, file.RelativePath)
+	}
+	sort.Strings(paths)
+
+	if expected := []string{"", "/a.txt", "/b.txt", "/c", "/c/d.txt"}; !reflect.DeepEqual(paths, expected) {
+		t.Fatalf("expected listing %v, got %v", expected, paths)
+	}
+
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		srv.Move("/root/a.txt", "/root/e.txt")
+		srv.Remove("/root/c")
+	}()
+
+	var actions []string
+	for len(actions) < 2 && scanner.Next(ctx) {
+		action := scanner.Entry()
+		actions = append(actions, string(action.Type)+" "+action.File.RelativePath)
+	}
+
+	if expected := []string{"move /e.txt", "delete /c"}; !reflect.DeepEqual(actions, expected) {
+		t.Fatalf("expected changes %v, got %v (%v)", expected, actions, scanner.Err())
+	}
+
+	srv.ResetCursors()
+	srv.WriteFile("/root/f.txt", []byte("f"))
+
+	if scanner.Next(ctx) || !dropbox.IsReset(scanner.Err()) {
+		t.Fatalf("expected the cursor to be reset, got %v", scanner.Err())
+	}
+}
+
+func TestExpiredToken(t *testing.T) {
+	srv := dropboxtest.NewServer()
+	defer srv.Close()
+
+	client := srv.Client()
+	srv.WriteFile("/file.txt", []byte("content"))
+	srv.ExpireToken()
+
+	_, err := dropbox.FileMetadata(context.Background(), client, "/file.txt")
+	if err != nil {
+		t.Fatalf("expected the access token to be renewed, got %s", err)
+	}
+}
+
+func discardLogger() *logrus.Entry {
+	logger := logrus.New()
+	logger.Out = ioutil.Discard
+
+	return logrus.NewEntry(logger)
+}
@@ -0,0 +1,365 @@
+package dropboxtest
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/kdisneur/dropbox_sync/pkg/dropbox"
+	"github.com/kdisneur/dropbox_sync/pkg/dropbox/internal"
+)
+
+// failure represents an error response sent back by the server
+type failure struct {
+	details interface{}
+	status  int
+	summary string
+}
+
+func (f *failure) Error() string {
+	return f.summary
+}
+
+func conflict(summary string) error {
+	return &failure{status: http.StatusConflict, summary: summary}
+}
+
+// writeMode represents what happens when an uploaded file already exists
+type writeMode struct {
+	tag string
+	rev string
+}
+
+// isWriteConflict reports whether a file can't be written because its path is taken
+func isWriteConflict(err error) bool {
+	f, ok := err.(*failure)
+
+	return ok && strings.HasPrefix(f.summary, "path/conflict/")
+}
+
+// renamed returns the name Dropbox gives to a file when its path is taken, such
+// as "file (1).txt"
+func renamed(filePath string, i int) string {
+	extension := path.Ext(filePath)
+	if extension == path.Base(filePath) {
+		extension = ""
+	}
+
+	return fmt.Sprintf("%s (%d)%s", strings.TrimSuffix(filePath, extension), i, extension)
+}
+
+// key returns the case insensitive identifier of a path, like Dropbox does
+func key(filePath string) string {
+	return strings.ToLower(filePath)
+}
+
+func isBelow(candidate string, folder string) bool {
+	return folder == "" || candidate == folder || strings.HasPrefix(candidate, folder+"/")
+}
+
+func validPath(filePath string) bool {
+	return strings.HasPrefix(filePath, "/") && !strings.HasSuffix(filePath, "/") && path.Clean(filePath) == filePath
+}
+
+func (s *Server) lookupFile(filePath string) (*entry, error) {
+	stored, ok := s.entries[key(filePath)]
+	if !ok {
+		return nil, conflict("path/not_found/..")
+	}
+
+	if stored.metadata.Tag != "file" {
+		return nil, conflict("path/not_file/..")
+	}
+
+	return stored, nil
+}
+
+// writeFile stores a file according to the write mode, creating its missing parents
+func (s *Server) writeFile(filePath string, content []byte, mode writeMode) (*entry, error) {
+	if !validPath(filePath) {
+		return nil, conflict("path/malformed_path/..")
+	}
+
+	existing, exists := s.entries[key(filePath)]
+	if exists && existing.metadata.Tag == "folder" {
+		return nil, conflict("path/conflict/folder/..")
+	}
+
+	switch mode.tag {
+	case "add":
+		if exists && !bytes.Equal(existing.content, content) {
+			return nil, conflict("path/conflict/file/..")
+		}
+	case "update":
+		if !exists || existing.metadata.Rev != mode.rev {
+			return nil, conflict("path/conflict/file/..")
+		}
+	}
+
+	if exists && bytes.Equal(existing.content, content) {
+		return existing, nil
+	}
+
+	err := s.createParents(filePath)
+	if err != nil {
+		return nil, err
+	}
+
+	contentHash, err := dropbox.HashFromReader(bytes.NewReader(content))
+	if err != nil {
+		return nil, err
+	}
+
+	id := s.nextID()
+	if exists {
+		id = existing.metadata.ID
+	}
+
+	stored := &entry{
+		content: content,
+		metadata: internal.FileMetadataResponse{
+			ID:             id,
+			Tag:            "file",
+			Name:           path.Base(filePath),
+			Path:           filePath,
+			ContentHash:    contentHash,
+			Rev:            s.nextRev(),
+			Size:           int64(len(content)),
+			ServerModified: time.Now().UTC().Truncate(time.Second),
+		},
+	}
+
+	s.store(stored)
+
+	return stored, nil
+}
+
+// createFolder stores a folder, creating its missing parents
+func (s *Server) createFolder(folderPath string) (*entry, error) {
+	if !validPath(folderPath) {
+		return nil, conflict("path/malformed_path/..")
+	}
+
+	if existing, exists := s.entries[key(folderPath)]; exists {
+		return nil, conflict(fmt.Sprintf("path/conflict/%s/..", existing.metadata.Tag))
+	}
+
+	err := s.createParents(folderPath)
+	if err != nil {
+		return nil, err
+	}
+
+	stored := &entry{
+		metadata: internal.FileMetadataResponse{
+			ID:   s.nextID(),
+			Tag:  "folder",
+			Name: path.Base(folderPath),
+			Path: folderPath,
+		},
+	}
+
+	s.store(stored)
+
+	return stored, nil
+}
+
+func (s *Server) createParents(filePath string) error {
+	parent := path.Dir(filePath)
+	if parent == "/" {
+		return nil
+	}
+
+	existing, exists := s.entries[key(parent)]
+	if !exists {
+		_, err := s.createFolder(parent)
+		return err
+	}
+
+	if existing.metadata.Tag != "folder" {
+		return conflict("path/conflict/file_ancestor/..")
+	}
+
+	return nil
+}
+
+// remove deletes a file or a folder with everything it contains. Like Dropbox, a
+// single deletion is reported for the whole tree
+func (s *Server) remove(filePath string) (*entry, error) {
+	stored, ok := s.entries[key(filePath)]
+	if !ok {
+		return nil, conflict("path_lookup/not_found/..")
+	}
+
+	for _, removed := range s.tree(key(filePath)) {
+		delete(s.entries, key(removed.metadata.Path))
+	}
+
+	s.record(internal.FileMetadataResponse{Tag: "deleted", Name: stored.metadata.Name, Path: stored.metadata.Path})
+
+	return stored, nil
+}
+
+// move renames a file or a folder. Like Dropbox, it is reported as a deletion of
+// the old path followed by every entry of the new tree, with unchanged IDs
+func (s *Server) move(fromPath string, toPath string) (*entry, error) {
+	source, ok := s.entries[key(fromPath)]
+	if !ok {
+		return nil, conflict("from_lookup/not_found/..")
+	}
+
+	if !validPath(toPath) {
+		return nil, conflict("to/malformed_path/..")
+	}
+
+	if key(fromPath) != key(toPath) && isBelow(key(toPath), key(fromPath)) {
+		return nil, conflict("duplicated_or_nested_paths/..")
+	}
+
+	if existing, exists := s.entries[key(toPath)]; exists && key(fromPath) != key(toPath) {
+		return nil, conflict(fmt.Sprintf("to/conflict/%s/..", existing.metadata.Tag))
+	}
+
+	moved := s.tree(key(fromPath))
+	for _, stored := range moved {
+		delete(s.entries, key(stored.metadata.Path))
+	}
+
+	err := s.createParents(toPath)
+	if err != nil {
+		for _, stored := range moved {
+			s.entries[key(stored.metadata.Path)] = stored
+		}
+
+		return nil, err
+	}
+
+	s.record(internal.FileMetadataResponse{Tag: "deleted", Name: source.metadata.Name, Path: source.metadata.Path})
+
+	var root *entry
+	for _, stored := range moved {
+		renamed := &entry{content: stored.content, metadata: stored.metadata}
+		renamed.metadata.Path = toPath + strings.TrimPrefix(stored.metadata.Path, source.metadata.Path)
+		renamed.metadata.Name = path.Base(renamed.metadata.Path)
+
+		if renamed.metadata.Tag == "file" {
+			renamed.metadata.Rev = s.nextRev()
+		}
+
+		s.store(renamed)
+
+		if root == nil {
+			root = renamed
+		}
+	}
+
+	return root, nil
+}
+
+// tree returns an entry and everything it contains, parents first
+func (s *Server) tree(folderKey string) []*entry {
+	var found []*entry
+	for candidate, stored := range s.entries {
+		if isBelow(candidate, folderKey) {
+			found = append(found, stored)
+		}
+	}
+
+	sort.Slice(found, func(i, j int) bool {
+		return key(found[i].metadata.Path) < key(found[j].metadata.Path)
+	})
+
+	return found
+}
+
+func (s *Server) store(stored *entry) {
+	s.entries[key(stored.metadata.Path)] = stored
+	s.record(stored.metadata)
+}
+
+// record appends a change to the journal and wakes up the pending long polls
+func (s *Server) record(metadata internal.FileMetadataResponse) {
+	s.journal = append(s.journal, metadata)
+
+	close(s.changed)
+	s.changed = make(chan struct{})
+}
+
+func (s *Server) nextID() string {
+	s.lastID++
+
+	return fmt.Sprintf("id:%d", s.lastID)
+}
+
+func (s *Server) nextRev() string {
+	s.lastRev++
+
+	return fmt.Sprintf("%09x", s.lastRev)
+}
+
+// startListing returns a cursor holding every entry below a folder, the folder included
+func (s *Server) startListing(folderPath string) (cursor, error) {
+	folderKey := key(folderPath)
+	if folderKey != "" {
+		folder, ok := s.entries[folderKey]
+		if !ok {
+			return cursor{}, conflict("path/not_found/..")
+		}
+
+		if folder.metadata.Tag != "folder" {
+			return cursor{}, conflict("path/not_folder/..")
+		}
+	}
+
+	listing := cursor{path: folderKey, position: len(s.journal)}
+	for _, stored := range s.tree(folderKey) {
+		listing.pending = append(listing.pending, stored.metadata)
+	}
+
+	return listing, nil
+}
+
+// continueListing returns the cursor to use after the given one, loaded with the
+// changes recorded since when it has nothing pending anymore
+func (s *Server) continueListing(token string) (cursor, error) {
+	current, ok := s.cursors[token]
+	if !ok {
+		return cursor{}, conflict("reset/..")
+	}
+
+	if len(current.pending) > 0 {
+		return current, nil
+	}
+
+	next := cursor{path: current.path, position: len(s.journal)}
+	for _, change := range s.journal[current.position:] {
+		if isBelow(key(change.Path), current.path) {
+			next.pending = append(next.pending, change)
+		}
+	}
+
+	return next, nil
+}
+
+// page returns the next entries of a cursor and saves the cursor to use after them
+func (s *Server) page(current cursor) internal.ListFolderResponse {
+	entries := current.pending
+	if s.PageSize > 0 && len(entries) > s.PageSize {
+		entries = entries[:s.PageSize]
+	}
+
+	next := cursor{path: current.path, pending: current.pending[len(entries):], position: current.position}
+
+	s.lastCursor++
+	token := fmt.Sprintf("cursor-%d", s.lastCursor)
+	s.cursors[token] = next
+
+	if entries == nil {
+		entries = []internal.FileMetadataResponse{}
+	}
+
+	return internal.ListFolderResponse{Entries: entries, Cursor: token, HasMore: len(next.pending) > 0}
+}
@@ -0,0 +1,36 @@
+package dropbox
+
+import (
+	"net/http"
+
+	"github.com/kdisneur/dropbox_sync/pkg/dropbox/internal"
+	"github.com/pkg/errors"
+)
+
+// Error represents an error response sent back by Dropbox. Its `Summary` is the
+// `error_summary` field, like "path/not_found/..."
+type Error = internal.APIError
+
+// IsConflict reports whether the error is a Dropbox conflict, like an upload
+// based on an outdated revision
+func IsConflict(err error) bool {
+	apiErr, ok := errors.Cause(err).(*Error)
+
+	return ok && apiErr.StatusCode == http.StatusConflict && apiErr.HasSummaryPrefix("path/conflict")
+}
+
+// IsReset reports whether Dropbox expired a listing cursor. The folder has to be
+// listed again from scratch
+func IsReset(err error) bool {
+	apiErr, ok := errors.Cause(err).(*Error)
+
+	return ok && apiErr.StatusCode == http.StatusConflict && apiErr.HasSummaryPrefix("reset")
+}
+
+// IsNotFound reports whether the error is caused by a missing file or folder
+func IsNotFound(err error) bool {
+	apiErr, ok := errors.Cause(err).(*Error)
+
+	return ok && apiErr.StatusCode == http.StatusConflict &&
+		(apiErr.HasSummaryPrefix("path/not_found") || apiErr.HasSummaryPrefix("path_lookup/not_found"))
+}
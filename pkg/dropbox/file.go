@@ -1,8 +1,13 @@
 package dropbox
 
 import (
+	"context"
 	"encoding/json"
+	"io"
+	"time"
+
 	"github.com/kdisneur/dropbox_sync/pkg/dropbox/internal"
+	"github.com/pkg/errors"
 )
 
 const (
@@ -14,44 +19,106 @@ const (
 
 // File represents a file or folder on Dropbox
 type File struct {
-	ID           string
-	ContentHash  string
-	Name         string
-	RelativePath string
-	RemotePath   string
-	Type         internal.FileType
+	ID             string
+	ContentHash    string
+	Name           string
+	RelativePath   string
+	RemotePath     string
+	Rev            string
+	ServerModified time.Time
+	Size           int64
+	Type           internal.FileType
+}
+
+// WriteMode represents what Dropbox does when an uploaded file already exists
+type WriteMode struct {
+	autorename bool
+	tag        string
+	rev        string
+}
+
+var (
+	// WriteModeAdd never overwrites an existing file
+	WriteModeAdd = WriteMode{tag: "add"}
+	// WriteModeAddRenamed never overwrites an existing file. The file is saved under
+	// a free name, such as "file (1).txt", when the path is taken
+	WriteModeAddRenamed = WriteMode{autorename: true, tag: "add"}
+)
+
+// WriteModeUpdate overwrites the file only if its current revision is the given one
+func WriteModeUpdate(rev string) WriteMode {
+	return WriteMode{tag: "update", rev: rev}
+}
+
+func (m WriteMode) value() interface{} {
+	if m.tag == "update" {
+		return map[string]interface{}{".tag": m.tag, "update": m.rev}
+	}
+
+	return m.tag
 }
 
 // FileDelete deletes a file if present on Dropbox
-func FileDelete(client Client, path string) error {
-	_, err := FileMetadata(client, path)
-	if err != nil {
+func FileDelete(ctx context.Context, client Client, path string) error {
+	_, err := FileMetadata(ctx, client, path)
+	if IsNotFound(err) {
 		return nil
 	}
 
+	if err != nil {
+		return err
+	}
+
 	_, err = internal.POSTWithBody(
-		"https://api.dropboxapi.com/2/files/delete_v2",
-		client.token,
+		ctx,
+		client.notIdempotentSession(),
+		client.Endpoints.api("/2/files/delete_v2"),
 		map[string]interface{}{"path": path},
 	)
 
 	return err
 }
 
-// FileDownload downloads a file from the user's Dropbox
-func FileDownload(client Client, path string) ([]byte, error) {
-	return internal.POSTWithDataHeaders(
-		"https://content.dropboxapi.com/2/files/download",
-		client.token,
+// FileDownloadTo streams a file from the user's Dropbox to a writer and returns its
+// metadata. It fails when the content received doesn't match the Dropbox content hash
+func FileDownloadTo(ctx context.Context, client Client, path string, writer io.Writer) (*File, error) {
+	response, err := internal.POSTWithDataHeadersForStream(
+		ctx,
+		client.session(),
+		client.Endpoints.content("/2/files/download"),
 		map[string]interface{}{"path": path},
 	)
+
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+
+	metadata := &internal.FileMetadataResponse{}
+	err = json.Unmarshal([]byte(response.Header.Get("Dropbox-API-Result")), metadata)
+	if err != nil {
+		return nil, errors.Wrap(err, "can't parse downloaded file metadata")
+	}
+
+	hasher := NewContentHasher()
+	_, err = io.Copy(io.MultiWriter(writer, hasher), response.Body)
+	if err != nil {
+		return nil, errors.Wrapf(err, "can't download file '%s'", path)
+	}
+
+	if hasher.Sum() != metadata.ContentHash {
+		return nil, errors.Errorf("content hash mismatch after downloading '%s'", path)
+	}
+
+	return fileFromAPI(metadata), nil
 }
 
 // FileMetadata fetches file metadata from Dropbox
-func FileMetadata(client Client, path string) (*File, error) {
+func FileMetadata(ctx context.Context, client Client, path string) (*File, error) {
 	body, err := internal.POSTWithBody(
-		"https://api.dropboxapi.com/2/files/get_metadata",
-		client.token,
+		ctx,
+		client.session(),
+		client.Endpoints.api("/2/files/get_metadata"),
 		map[string]interface{}{"path": path, "include_deleted": false},
 	)
 
@@ -68,24 +135,49 @@ func FileMetadata(client Client, path string) (*File, error) {
 	return fileFromAPI(response), nil
 }
 
-// FileUpload uploads a file to Dropbox
-func FileUpload(client Client, remotePath string, content []byte) error {
-	file, err := FileMetadata(client, remotePath)
-	if err == nil {
-		localHash, errHash := HashFromBytes(content)
-		if errHash == nil && localHash == file.ContentHash {
-			return nil
-		}
+// FileMove moves a file or folder to a new path on Dropbox and returns its new metadata
+func FileMove(ctx context.Context, client Client, fromPath string, toPath string) (*File, error) {
+	body, err := internal.POSTWithBody(
+		ctx,
+		client.notIdempotentSession(),
+		client.Endpoints.api("/2/files/move_v2"),
+		map[string]interface{}{"from_path": fromPath, "to_path": toPath, "autorename": false},
+	)
+
+	if err != nil {
+		return nil, err
 	}
 
-	_, err = internal.POSTWithDataHeadersAndBinary(
-		"https://content.dropboxapi.com/2/files/upload",
-		client.token,
-		map[string]interface{}{"path": remotePath, "mode": "add", "autorename": false, "mute": false},
+	response := &internal.RelocationResponse{}
+	err = json.Unmarshal(body, response)
+	if err != nil {
+		return nil, err
+	}
+
+	return fileFromAPI(&response.Metadata), nil
+}
+
+// FileUpload uploads a file to Dropbox and returns its new metadata
+func FileUpload(ctx context.Context, client Client, remotePath string, content []byte, mode WriteMode) (*File, error) {
+	body, err := internal.POSTWithDataHeadersAndBinary(
+		ctx,
+		client.notIdempotentSession(),
+		client.Endpoints.content("/2/files/upload"),
+		map[string]interface{}{"path": remotePath, "mode": mode.value(), "autorename": mode.autorename, "mute": false},
 		content,
 	)
 
-	return err
+	if err != nil {
+		return nil, err
+	}
+
+	response := &internal.FileMetadataResponse{}
+	err = json.Unmarshal(body, response)
+	if err != nil {
+		return nil, err
+	}
+
+	return fileFromAPI(response), nil
 }
 
 func fileFromAPI(entry *internal.FileMetadataResponse) *File {
@@ -96,12 +188,15 @@ func fileFromAPI(entry *internal.FileMetadataResponse) *File {
 	}
 
 	file := File{
-		ID:           entry.ID,
-		ContentHash:  entry.ContentHash,
-		Name:         entry.Name,
-		RelativePath: entry.Path,
-		RemotePath:   entry.Path,
-		Type:         fileType,
+		ID:             entry.ID,
+		ContentHash:    entry.ContentHash,
+		Name:           entry.Name,
+		RelativePath:   entry.Path,
+		RemotePath:     entry.Path,
+		Rev:            entry.Rev,
+		ServerModified: entry.ServerModified,
+		Size:           entry.Size,
+		Type:           fileType,
 	}
 
 	return &file
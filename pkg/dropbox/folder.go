@@ -1,14 +1,16 @@
 package dropbox
 
 import (
+	"context"
 	"github.com/kdisneur/dropbox_sync/pkg/dropbox/internal"
 )
 
 // FolderCreate creates a folder on Dropbox if not present on Dropbox
-func FolderCreate(client Client, path string) error {
+func FolderCreate(ctx context.Context, client Client, path string) error {
 	_, err := internal.POSTWithBody(
-		"https://api.dropboxapi.com/2/files/create_folder_v2",
-		client.token,
+		ctx,
+		client.notIdempotentSession(),
+		client.Endpoints.api("/2/files/create_folder_v2"),
 		map[string]interface{}{"path": path, "autorename": false},
 	)
 
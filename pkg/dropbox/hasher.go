@@ -1,7 +1,6 @@
 package dropbox
 
 import (
-	"bytes"
 	"crypto/sha256"
 	"fmt"
 	"hash"
@@ -9,65 +8,117 @@ import (
 	"os"
 
 	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
 )
 
 // ContentHashBlockSize size of Dropbox hash
 const ContentHashBlockSize = 4 * 1024 * 1024
 
-// ContentHasher represents a Dropbox content hasher
+// ContentHasher represents a Dropbox content hasher. Content can be written in
+// pieces of any size
 // https://www.dropbox.com/developers/reference/content-hash
 type ContentHasher struct {
-	err             error
-	overallChecksum hash.Hash
-	partialChecksum [32]byte
+	blockChecksum  hash.Hash
+	blockChecksums []byte
+	blockLength    int
 }
 
-// HashFromBytes computes a hash on bytes
-func HashFromBytes(content []byte) (string, error) {
-	reader := bytes.NewReader(content)
+// NewContentHasher creates a new Dropbox content hasher
+func NewContentHasher() *ContentHasher {
+	return &ContentHasher{blockChecksum: sha256.New()}
+}
 
-	return HashFromReader(reader)
+// HashCache remembers the content hashes of local files which didn't change
+// since they were hashed
+type HashCache interface {
+	Hash(filePath string, info os.FileInfo) (string, bool)
+	Put(filePath string, info os.FileInfo, hash string) error
 }
 
-// HashFromFile computes a hash from a file path
-func HashFromFile(path string) (string, error) {
+// HashFromFile computes a hash from a file path. The cache, when not nil, is
+// consulted first and updated when the file didn't change while being read
+func HashFromFile(path string, cache HashCache) (string, error) {
 	reader, err := os.Open(path)
 	if err != nil {
 		return "", errors.Wrapf(err, "can't open file '%s'", path)
 	}
 	defer reader.Close()
 
-	return HashFromReader(reader)
+	if cache == nil {
+		return HashFromReader(reader)
+	}
+
+	before, err := reader.Stat()
+	if err != nil {
+		return "", errors.Wrapf(err, "can't stat file '%s'", path)
+	}
+
+	if sum, ok := cache.Hash(path, before); ok {
+		return sum, nil
+	}
+
+	sum, err := HashFromReader(reader)
+	if err != nil {
+		return "", err
+	}
+
+	after, err := os.Stat(path)
+	if err == nil && os.SameFile(before, after) && after.Size() == before.Size() && after.ModTime().Equal(before.ModTime()) {
+		err = cache.Put(path, after, sum)
+		if err != nil {
+			logrus.Warnf("can't cache hash of '%s': %s", path, err)
+		}
+	}
+
+	return sum, nil
 }
 
 // HashFromReader computes a hash from a Reader
 func HashFromReader(reader io.Reader) (string, error) {
-	c := &ContentHasher{overallChecksum: sha256.New()}
-
-	return c.computeHash(reader)
-}
+	c := NewContentHasher()
 
-func (c *ContentHasher) computeHash(reader io.Reader) (string, error) {
-	for c.nextPartialChecksum(reader) {
-		c.overallChecksum.Write(c.partialChecksum[:])
+	_, err := io.Copy(c, reader)
+	if err != nil {
+		return "", err
 	}
 
-	return fmt.Sprintf("%x", c.overallChecksum.Sum(nil)), c.err
+	return c.Sum(), nil
 }
 
-func (c *ContentHasher) nextPartialChecksum(reader io.Reader) bool {
-	partialFileContent := make([]byte, ContentHashBlockSize)
-	bytesRead, err := reader.Read(partialFileContent)
-	if err != nil && err != io.EOF {
-		c.err = err
-		return false
+// Write adds content to the hash
+func (c *ContentHasher) Write(content []byte) (int, error) {
+	written := len(content)
+
+	for len(content) > 0 {
+		size := ContentHashBlockSize - c.blockLength
+		if size > len(content) {
+			size = len(content)
+		}
+
+		c.blockChecksum.Write(content[:size])
+		c.blockLength += size
+		content = content[size:]
+
+		if c.blockLength == ContentHashBlockSize {
+			c.closeBlock()
+		}
 	}
 
-	if err == io.EOF {
-		return false
+	return written, nil
+}
+
+// Sum returns the hash of the content written so far
+func (c *ContentHasher) Sum() string {
+	blockChecksums := c.blockChecksums
+	if c.blockLength > 0 {
+		blockChecksums = c.blockChecksum.Sum(blockChecksums[:len(blockChecksums):len(blockChecksums)])
 	}
 
-	c.partialChecksum = sha256.Sum256(partialFileContent[:bytesRead])
+	return fmt.Sprintf("%x", sha256.Sum256(blockChecksums))
+}
 
-	return true
+func (c *ContentHasher) closeBlock() {
+	c.blockChecksums = c.blockChecksum.Sum(c.blockChecksums)
+	c.blockChecksum.Reset()
+	c.blockLength = 0
 }
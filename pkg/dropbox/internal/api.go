@@ -2,6 +2,7 @@ package internal
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"io"
@@ -11,53 +12,84 @@ import (
 	"github.com/pkg/errors"
 )
 
-func POSTWithDataHeadersAndBinary(url string, token string, data map[string]interface{}, content []byte) ([]byte, error) {
+// Session represents what every request sent to Dropbox needs
+type Session struct {
+	// Download and Upload limit the rate of the bytes received and sent
+	Download   []*Bucket
+	HTTPClient *http.Client
+	// NotIdempotent requests change something each time Dropbox processes them, so
+	// they are sent again only when the failed attempt provably wasn't processed
+	NotIdempotent bool
+	Retry         RetryPolicy
+	Tokens        TokenSource
+	Upload        []*Bucket
+}
+
+// TokenSource provides the access token sent with authenticated requests
+type TokenSource interface {
+	// Token returns a valid access token, renewed when it is about to expire
+	Token(ctx context.Context) (string, error)
+	// Refresh renews the access token after Dropbox rejected it as expired
+	Refresh(ctx context.Context, rejected string) (string, error)
+}
+
+func (s Session) httpClient() *http.Client {
+	if s.HTTPClient == nil {
+		return http.DefaultClient
+	}
+
+	return s.HTTPClient
+}
+
+func POSTWithDataHeadersAndBinary(ctx context.Context, session Session, url string, data map[string]interface{}, content []byte) ([]byte, error) {
 	arguments, err := json.Marshal(data)
 	if err != nil {
 		return nil, errors.Wrap(err, "can't encode POST body request")
 	}
 
 	header := http.Header{}
-	header.Set("Authorization", fmt.Sprintf("Bearer %s", token))
 	header.Set("Content-Type", "application/octet-stream")
 	header.Set("Dropbox-API-Arg", string(arguments))
 
-	return doPOSTRequestWithBinary(url, header, content)
+	return doPOSTRequestWithBinary(ctx, session, url, header, content)
 }
 
-func POSTWithDataHeaders(url string, token string, data map[string]interface{}) ([]byte, error) {
+// POSTWithDataHeadersForStream posts data in the Dropbox-API-Arg header and returns the
+// response for the caller to stream and close
+func POSTWithDataHeadersForStream(ctx context.Context, session Session, url string, data map[string]interface{}) (*http.Response, error) {
 	arguments, err := json.Marshal(data)
 	if err != nil {
 		return nil, errors.Wrap(err, "can't encode POST body request")
 	}
 
 	header := http.Header{}
-	header.Set("Authorization", fmt.Sprintf("Bearer %s", token))
 	header.Set("Dropbox-API-Arg", string(arguments))
 
-	return doPOSTRequestWithBinary(url, header, nil)
+	return doPOSTRequest(ctx, session, url, header, nil)
 }
 
 // POSTWithBody posts data and read the response back. It returns an error when status code is
 // greater than or equal to 400
-func POSTWithBody(url string, token string, data map[string]interface{}) ([]byte, error) {
+func POSTWithBody(ctx context.Context, session Session, url string, data map[string]interface{}) ([]byte, error) {
 	header := http.Header{}
-	header.Set("Authorization", fmt.Sprintf("Bearer %s", token))
-	header.Set("Content-Type", "application/json")
+	if data != nil {
+		header.Set("Content-Type", "application/json")
+	}
 
-	return doPOSTRequestWithJSON(url, header, data)
+	return doPOSTRequestWithJSON(ctx, session, url, header, data)
 }
 
 // UnuathenticatedPOSTWithBody posts data and read the response back. It returns an error when status code is
 // greater than or equal to 400
-func UnuathenticatedPOSTWithBody(url string, data map[string]interface{}) ([]byte, error) {
+func UnuathenticatedPOSTWithBody(ctx context.Context, session Session, url string, data map[string]interface{}) ([]byte, error) {
 	header := http.Header{}
 	header.Set("Content-Type", "application/json")
+	session.Tokens = nil
 
-	return doPOSTRequestWithJSON(url, header, data)
+	return doPOSTRequestWithJSON(ctx, session, url, header, data)
 }
 
-func doPOSTRequestWithJSON(url string, headers http.Header, data map[string]interface{}) ([]byte, error) {
+func doPOSTRequestWithJSON(ctx context.Context, session Session, url string, headers http.Header, data map[string]interface{}) ([]byte, error) {
 	var body []byte
 	var err error
 
@@ -68,37 +100,135 @@ func doPOSTRequestWithJSON(url string, headers http.Header, data map[string]inte
 		}
 	}
 
-	return doPOSTRequestWithBinary(url, headers, body)
+	return doPOSTRequestWithBinary(ctx, session, url, headers, body)
+}
+
+func doPOSTRequestWithBinary(ctx context.Context, session Session, url string, headers http.Header, data []byte) ([]byte, error) {
+	response, err := doPOSTRequest(ctx, session, url, headers, data)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+
+	body, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		return nil, errors.Wrap(err, "can't read POST response")
+	}
+
+	return body, nil
+}
+
+// doPOSTRequest executes a request, sending it again according to the retry policy,
+// and returns the response for the caller to read and close. It returns an error
+// when status code is greater than or equal to 400
+func doPOSTRequest(ctx context.Context, session Session, url string, headers http.Header, data []byte) (*http.Response, error) {
+	var lastErr error
+
+	for attempt := 0; attempt < session.Retry.attempts(); attempt++ {
+		if attempt > 0 {
+			err := session.Retry.wait(ctx, attempt, lastErr)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		response, err := doAuthenticatedPOSTRequestOnce(ctx, session, url, headers, data)
+		if err == nil {
+			return response, nil
+		}
+
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+
+		if !IsTransient(err) || session.NotIdempotent && !IsUnprocessed(err) {
+			return nil, err
+		}
+
+		lastErr = err
+	}
+
+	return nil, lastErr
+}
+
+// doAuthenticatedPOSTRequestOnce executes a request with the current access token.
+// When Dropbox rejects it as expired, the token is renewed and the request sent again
+func doAuthenticatedPOSTRequestOnce(ctx context.Context, session Session, url string, headers http.Header, data []byte) (*http.Response, error) {
+	if session.Tokens == nil {
+		return doPOSTRequestOnce(ctx, session, url, headers, data)
+	}
+
+	token, err := session.Tokens.Token(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	response, err := doPOSTRequestOnce(ctx, session, url, withAuthorization(headers, token), data)
+	if !isExpiredToken(err) {
+		return response, err
+	}
+
+	token, err = session.Tokens.Refresh(ctx, token)
+	if err != nil {
+		return nil, err
+	}
+
+	return doPOSTRequestOnce(ctx, session, url, withAuthorization(headers, token), data)
+}
+
+func withAuthorization(headers http.Header, token string) http.Header {
+	authorized := headers.Clone()
+	authorized.Set("Authorization", fmt.Sprintf("Bearer %s", token))
+
+	return authorized
 }
 
-func doPOSTRequestWithBinary(url string, headers http.Header, data []byte) ([]byte, error) {
-	var bodyReader io.Reader
+func doPOSTRequestOnce(ctx context.Context, session Session, url string, headers http.Header, data []byte) (*http.Response, error) {
+	var request *http.Request
+	var err error
 
 	if data != nil {
-		bodyReader = bytes.NewReader(data)
+		request, err = http.NewRequest("POST", url, bytes.NewReader(data))
+	} else {
+		request, err = http.NewRequest("POST", url, nil)
 	}
 
-	request, err := http.NewRequest("POST", url, bodyReader)
 	if err != nil {
 		return nil, errors.Wrap(err, "can't create new POST request")
 	}
 
+	if len(data) > 0 && len(session.Upload) > 0 {
+		request.GetBody = func() (io.ReadCloser, error) {
+			return ioutil.NopCloser(newLimitedReader(ctx, bytes.NewReader(data), session.Upload)), nil
+		}
+		request.Body, _ = request.GetBody()
+	}
+
+	request = request.WithContext(ctx)
 	request.Header = headers
 
-	var client http.Client
-	response, err := client.Do(request)
+	response, err := session.httpClient().Do(request)
 	if err != nil {
 		return nil, errors.Wrap(err, "can't execute new POST request")
 	}
 
-	body, err := ioutil.ReadAll(response.Body)
-	if err != nil {
-		return nil, errors.Wrap(err, "can't read POST response")
+	if response.StatusCode >= 400 {
+		defer response.Body.Close()
+
+		body, err := ioutil.ReadAll(response.Body)
+		if err != nil {
+			return nil, errors.Wrap(err, "can't read POST response")
+		}
+
+		return nil, newAPIError(response, body)
 	}
 
-	if response.StatusCode >= 400 {
-		return nil, fmt.Errorf("error when POSTing the request. detail: %s", body)
+	if len(session.Download) > 0 {
+		response.Body = limitedReadCloser{
+			Reader: newLimitedReader(ctx, response.Body, session.Download),
+			Closer: response.Body,
+		}
 	}
 
-	return body, nil
+	return response, nil
 }
@@ -0,0 +1,73 @@
+package internal
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+)
+
+func TestNotIdempotentRequestsAreNotReplayed(t *testing.T) {
+	var received int64
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt64(&received, 1)
+
+		// the request is processed but the response is lost
+		connection, _, err := w.(http.Hijacker).Hijack()
+		if err == nil {
+			connection.Close()
+		}
+	}))
+	defer server.Close()
+
+	for _, notIdempotent := range []bool{false, true} {
+		atomic.StoreInt64(&received, 0)
+		session := Session{NotIdempotent: notIdempotent, Retry: RetryPolicy{MaxAttempts: 3}}
+
+		_, err := POSTWithBody(context.Background(), session, server.URL, nil)
+		if err == nil {
+			t.Fatalf("expected the lost response to fail the request")
+		}
+
+		expected := int64(3)
+		if notIdempotent {
+			expected = 1
+		}
+
+		if count := atomic.LoadInt64(&received); count != expected {
+			t.Fatalf("expected %d attempts when not idempotent is %t, got %d", expected, notIdempotent, count)
+		}
+	}
+}
+
+func TestUnprocessedRequestsAreReplayed(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	url := "http://" + listener.Addr().String()
+	listener.Close()
+
+	_, err = POSTWithBody(context.Background(), Session{NotIdempotent: true, Retry: RetryPolicy{MaxAttempts: 2}}, url, nil)
+	if !IsUnprocessed(err) {
+		t.Fatalf("expected a connection failure to be unprocessed, got %v", err)
+	}
+
+	var received int64
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt64(&received, 1) == 1 {
+			w.WriteHeader(http.StatusTooManyRequests)
+			return
+		}
+
+		w.Write([]byte("{}"))
+	}))
+	defer server.Close()
+
+	_, err = POSTWithBody(context.Background(), Session{NotIdempotent: true, Retry: RetryPolicy{MaxAttempts: 2}}, server.URL, nil)
+	if err != nil || atomic.LoadInt64(&received) != 2 {
+		t.Fatalf("expected a rate limited request to be sent again, got %d attempts (%v)", received, err)
+	}
+}
@@ -0,0 +1,108 @@
+package internal
+
+import (
+	"context"
+	"io"
+	"sync"
+	"time"
+)
+
+// bucketReadSize is the largest read done at once through a limited reader, so a
+// transfer is spread over time instead of waiting for a whole buffer
+const bucketReadSize = 32 * 1024
+
+// Bucket is a token bucket filled with a rate of bytes per second which can change
+// over time. It holds at most one second of transfer. A zero rate is unlimited
+type Bucket struct {
+	last   time.Time
+	mutex  sync.Mutex
+	rate   func() int64
+	tokens float64
+}
+
+// NewBucket creates a bucket whose rate is read each time bytes are transferred
+func NewBucket(rate func() int64) *Bucket {
+	return &Bucket{rate: rate}
+}
+
+// Wait blocks until a number of bytes can be transferred
+func (b *Bucket) Wait(ctx context.Context, count int) error {
+	b.mutex.Lock()
+
+	now := time.Now()
+	rate := float64(b.rate())
+	if rate <= 0 {
+		b.last = time.Time{}
+		b.tokens = 0
+		b.mutex.Unlock()
+
+		return nil
+	}
+
+	if b.last.IsZero() {
+		b.tokens = rate
+	} else {
+		b.tokens += now.Sub(b.last).Seconds() * rate
+	}
+
+	if b.tokens > rate {
+		b.tokens = rate
+	}
+	b.last = now
+
+	// the bytes are reserved right away so concurrent transfers share the rate
+	b.tokens -= float64(count)
+	delay := time.Duration(-b.tokens / rate * float64(time.Second))
+	b.mutex.Unlock()
+
+	if delay <= 0 {
+		return nil
+	}
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+// limitedReader reads no faster than its buckets allow
+type limitedReader struct {
+	buckets []*Bucket
+	ctx     context.Context
+	reader  io.Reader
+}
+
+func newLimitedReader(ctx context.Context, reader io.Reader, buckets []*Bucket) io.Reader {
+	if len(buckets) == 0 {
+		return reader
+	}
+
+	return &limitedReader{buckets: buckets, ctx: ctx, reader: reader}
+}
+
+func (r *limitedReader) Read(p []byte) (int, error) {
+	if len(p) > bucketReadSize {
+		p = p[:bucketReadSize]
+	}
+
+	n, err := r.reader.Read(p)
+	for _, bucket := range r.buckets {
+		waitErr := bucket.Wait(r.ctx, n)
+		if waitErr != nil {
+			return n, waitErr
+		}
+	}
+
+	return n, err
+}
+
+// limitedReadCloser limits the reads of a response body and closes it
+type limitedReadCloser struct {
+	io.Reader
+	io.Closer
+}
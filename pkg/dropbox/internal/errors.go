@@ -0,0 +1,100 @@
+package internal
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// APIError represents an error response sent back by Dropbox
+// https://www.dropbox.com/developers/documentation/http/documentation#error-handling
+type APIError struct {
+	Body       []byte
+	RetryAfter time.Duration
+	StatusCode int
+	Summary    string
+}
+
+type errorResponse struct {
+	Summary string `json:"error_summary"`
+}
+
+func newAPIError(response *http.Response, body []byte) *APIError {
+	apiErr := &APIError{Body: body, StatusCode: response.StatusCode}
+
+	var parsed errorResponse
+	if json.Unmarshal(body, &parsed) == nil {
+		apiErr.Summary = parsed.Summary
+	}
+
+	seconds, err := strconv.Atoi(response.Header.Get("Retry-After"))
+	if err == nil && seconds > 0 {
+		apiErr.RetryAfter = time.Duration(seconds) * time.Second
+	}
+
+	return apiErr
+}
+
+func (e *APIError) Error() string {
+	if e.Summary != "" {
+		return fmt.Sprintf("dropbox error (status %d): %s", e.StatusCode, e.Summary)
+	}
+
+	return fmt.Sprintf("dropbox error (status %d): %s", e.StatusCode, e.Body)
+}
+
+func isExpiredToken(err error) bool {
+	apiErr, ok := errors.Cause(err).(*APIError)
+
+	return ok && apiErr.StatusCode == http.StatusUnauthorized && apiErr.HasSummaryPrefix("expired_access_token")
+}
+
+// HasSummaryPrefix reports whether the error summary starts with the given tag,
+// for instance "path/not_found"
+func (e *APIError) HasSummaryPrefix(tag string) bool {
+	return strings.HasPrefix(e.Summary, tag)
+}
+
+// ErrNoRefreshToken is returned when an expired access token can't be renewed
+var ErrNoRefreshToken = errors.New("Dropbox access token expired and can't be renewed. authenticate again")
+
+// IsTransient reports whether a failed request may succeed when sent again: network
+// errors, rate limiting and server errors
+func IsTransient(err error) bool {
+	if errors.Cause(err) == ErrNoRefreshToken {
+		return false
+	}
+
+	apiErr, ok := errors.Cause(err).(*APIError)
+	if !ok {
+		return true
+	}
+
+	return apiErr.StatusCode == http.StatusTooManyRequests || apiErr.StatusCode >= http.StatusInternalServerError
+}
+
+// IsUnprocessed reports whether a failed request provably wasn't processed by
+// Dropbox, so it can be sent again even when it isn't idempotent: the connection
+// couldn't be opened, or Dropbox refused it because of rate limiting or
+// unavailability
+func IsUnprocessed(err error) bool {
+	if apiErr, ok := errors.Cause(err).(*APIError); ok {
+		return apiErr.StatusCode == http.StatusTooManyRequests || apiErr.StatusCode == http.StatusServiceUnavailable
+	}
+
+	urlErr, ok := errors.Cause(err).(*url.Error)
+	if !ok {
+		return false
+	}
+
+	opErr, ok := urlErr.Err.(*net.OpError)
+
+	return ok && opErr.Op == "dial"
+}
@@ -1,8 +1,13 @@
 package internal
 
+import "time"
+
 // AccessTokenResponse represents ths JSON we get back from Dropbox
+// https://www.dropbox.com/developers/documentation/http/documentation#oauth2-token
 type AccessTokenResponse struct {
-	Token string `json:"access_token"`
+	Token        string `json:"access_token"`
+	ExpiresIn    int64  `json:"expires_in"`
+	RefreshToken string `json:"refresh_token"`
 }
 
 // ListFolderResponse represents the JSON we get back from Dropbox
@@ -16,11 +21,42 @@ type ListFolderResponse struct {
 // FileMetadataResponse represents a specific JSON entry we get back from Dropbox
 // https://www.dropbox.com/developers/documentation/http/documentation#files-list_folder
 type FileMetadataResponse struct {
-	ID          string `json:"id"`
-	Tag         string `json:".tag"`
-	Name        string `json:"name"`
-	Path        string `json:"path_display"`
-	ContentHash string `json:"content_hash"`
+	ID             string    `json:"id"`
+	Tag            string    `json:".tag"`
+	Name           string    `json:"name"`
+	Path           string    `json:"path_display"`
+	ContentHash    string    `json:"content_hash"`
+	Rev            string    `json:"rev"`
+	Size           int64     `json:"size"`
+	ServerModified time.Time `json:"server_modified"`
+}
+
+// RelocationResponse represents the JSON we get back from Dropbox after a move
+// https://www.dropbox.com/developers/documentation/http/documentation#files-move
+type RelocationResponse struct {
+	Metadata FileMetadataResponse `json:"metadata"`
+}
+
+// UploadSessionStartResponse represents the JSON we get back from Dropbox
+// https://www.dropbox.com/developers/documentation/http/documentation#files-upload_session-start
+type UploadSessionStartResponse struct {
+	SessionID string `json:"session_id"`
+}
+
+// UploadSessionErrorResponse represents the JSON error we get back from Dropbox
+// when appending to or finishing an upload session
+// https://www.dropbox.com/developers/documentation/http/documentation#files-upload_session-append
+type UploadSessionErrorResponse struct {
+	Error struct {
+		UploadSessionLookupError
+		LookupFailed *UploadSessionLookupError `json:"lookup_failed"`
+	} `json:"error"`
+}
+
+// UploadSessionLookupError represents why Dropbox can't find an upload session
+type UploadSessionLookupError struct {
+	Tag           string `json:".tag"`
+	CorrectOffset int64  `json:"correct_offset"`
 }
 
 // LongPollResponse represents the JSON we get back from Dropbox
@@ -0,0 +1,60 @@
+package internal
+
+import (
+	"context"
+	"math/rand"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// RetryPolicy represents how many times and how often a failed request is sent again
+type RetryPolicy struct {
+	InitialBackoff time.Duration
+	MaxAttempts    int
+	MaxBackoff     time.Duration
+}
+
+func (r RetryPolicy) attempts() int {
+	if r.MaxAttempts < 1 {
+		return 1
+	}
+
+	return r.MaxAttempts
+}
+
+// wait sleeps before sending a request again. It honours the delay asked by
+// Dropbox when rate limited, or backs off exponentially with some jitter
+func (r RetryPolicy) wait(ctx context.Context, attempt int, lastErr error) error {
+	delay := r.backoff(attempt)
+	if apiErr, ok := errors.Cause(lastErr).(*APIError); ok && apiErr.RetryAfter > 0 {
+		delay = apiErr.RetryAfter
+	}
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (r RetryPolicy) backoff(attempt int) time.Duration {
+	backoff := r.InitialBackoff
+	for i := 1; i < attempt && backoff < r.MaxBackoff; i++ {
+		backoff *= 2
+	}
+
+	if backoff > r.MaxBackoff {
+		backoff = r.MaxBackoff
+	}
+
+	if backoff <= 0 {
+		return 0
+	}
+
+	return backoff/2 + time.Duration(rand.Int63n(int64(backoff/2)+1))
+}
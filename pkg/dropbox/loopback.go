@@ -0,0 +1,123 @@
+package dropbox
+
+import (
+	"context"
+	"crypto/subtle"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+
+	"github.com/pkg/errors"
+)
+
+// DefaultLoopbackPort is the port of the loopback redirect URI. The redirect URI,
+// like "http://localhost:53682/dropbox/callback", has to be registered in the
+// Dropbox application settings
+const DefaultLoopbackPort = 53682
+
+const loopbackPath = "/dropbox/callback"
+
+// Loopback represents a temporary local HTTP server receiving the authorization
+// code when Dropbox redirects the browser to it
+type Loopback struct {
+	// OAuth2 is the OAuth2 configuration using the loopback redirect URI
+	OAuth2   OAuth2
+	codes    chan loopbackResult
+	listener net.Listener
+	server   *http.Server
+	state    string
+}
+
+type loopbackResult struct {
+	code string
+	err  error
+}
+
+// ListenLoopback starts a loopback HTTP server on the given port of 127.0.0.1,
+// used as the redirect URI of the authorization
+func (o OAuth2) ListenLoopback(port int) (*Loopback, error) {
+	state, err := randomString()
+	if err != nil {
+		return nil, err
+	}
+
+	listener, err := net.Listen("tcp", fmt.Sprintf("127.0.0.1:%d", port))
+	if err != nil {
+		return nil, errors.Wrap(err, "can't start loopback server")
+	}
+
+	l := &Loopback{
+		OAuth2:   o,
+		codes:    make(chan loopbackResult, 1),
+		listener: listener,
+		state:    state,
+	}
+	l.OAuth2.RedirectURI = fmt.Sprintf("http://localhost:%d%s", listener.Addr().(*net.TCPAddr).Port, loopbackPath)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc(loopbackPath, l.handleCallback)
+	l.server = &http.Server{Handler: mux}
+
+	go l.server.Serve(listener)
+
+	return l, nil
+}
+
+// AuthorizationURL returns the URL where the user needs to give its consent. It
+// carries a random state checked when Dropbox redirects the browser back
+func (l *Loopback) AuthorizationURL(codeVerifier string) *url.URL {
+	authorization := l.OAuth2.AuthorizationURL(codeVerifier)
+
+	query := authorization.Query()
+	query.Set("state", l.state)
+	authorization.RawQuery = query.Encode()
+
+	return authorization
+}
+
+// Wait returns the authorization code once Dropbox redirected the browser
+func (l *Loopback) Wait(ctx context.Context) (string, error) {
+	select {
+	case result := <-l.codes:
+		return result.code, result.err
+	case <-ctx.Done():
+		return "", ctx.Err()
+	}
+}
+
+// Close stops the loopback server
+func (l *Loopback) Close() error {
+	return l.server.Close()
+}
+
+// handleCallback receives the browser redirected by Dropbox. Requests with an
+// unexpected state are rejected, so only the authorization started here is used
+func (l *Loopback) handleCallback(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	if subtle.ConstantTimeCompare([]byte(query.Get("state")), []byte(l.state)) != 1 {
+		http.Error(w, "invalid state", http.StatusBadRequest)
+		return
+	}
+
+	result := loopbackResult{code: query.Get("code")}
+	if query.Get("error") != "" {
+		result.err = errors.Errorf("authorization refused: %s %s", query.Get("error"), query.Get("error_description"))
+	} else if result.code == "" {
+		result.err = errors.New("authorization code missing from the redirection")
+	}
+
+	select {
+	case l.codes <- result:
+	default:
+		http.Error(w, "authorization already received", http.StatusConflict)
+		return
+	}
+
+	if result.err != nil {
+		http.Error(w, result.err.Error(), http.StatusForbidden)
+		return
+	}
+
+	fmt.Fprintln(w, "dropbox_sync is authorized. You can close this window.")
+}
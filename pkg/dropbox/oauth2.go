@@ -1,45 +1,67 @@
 package dropbox
 
 import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
 	"encoding/json"
-	"fmt"
 	"io/ioutil"
 	"net/http"
 	"net/url"
 	"strings"
+	"time"
 
 	"github.com/kdisneur/dropbox_sync/pkg/dropbox/internal"
 	"github.com/pkg/errors"
 )
 
-// OAuth2 represents the data needed to connect to Dropbox
+// OAuth2 represents the data needed to connect to Dropbox. Without redirect URI,
+// Dropbox shows the authorization code for the user to copy
 type OAuth2 struct {
 	API          string
 	Site         string
 	ClientID     string
 	ClientSecret string
+	HTTPClient   *http.Client
 	RedirectURI  string
 }
 
 // NewOAuth2 represents the OAuth2 configuration to connect to Dropbox
 func NewOAuth2(clientID string, clientSecret string) OAuth2 {
 	return OAuth2{
-		API:          "https://api.dropboxapi.com",
+		API:          DefaultEndpoints.API,
 		Site:         "https://www.dropbox.com",
 		ClientID:     clientID,
 		ClientSecret: clientSecret,
-		RedirectURI:  "http://localhost/dropbox/callback",
+		HTTPClient:   http.DefaultClient,
 	}
 }
 
-// AuthorizationURL returns the URL where the user needs to give its consent
-func (o OAuth2) AuthorizationURL() *url.URL {
+// NewCodeVerifier returns a random PKCE code verifier, proving the authorization
+// code is exchanged by the one who asked for it
+// https://tools.ietf.org/html/rfc7636
+func NewCodeVerifier() (string, error) {
+	return randomString()
+}
+
+// AuthorizationURL returns the URL where the user needs to give its consent. It
+// asks for a refresh token so the access can be renewed without the user
+func (o OAuth2) AuthorizationURL(codeVerifier string) *url.URL {
 	authorization, _ := url.Parse(o.Site)
 	authorization.Path = "/oauth2/authorize"
 
+	challenge := sha256.Sum256([]byte(codeVerifier))
+
 	query := authorization.Query()
 	query.Set("client_id", o.ClientID)
 	query.Set("response_type", "code")
+	query.Set("token_access_type", "offline")
+	query.Set("code_challenge", base64.RawURLEncoding.EncodeToString(challenge[:]))
+	query.Set("code_challenge_method", "S256")
+	if o.RedirectURI != "" {
+		query.Set("redirect_uri", o.RedirectURI)
+	}
 	authorization.RawQuery = query.Encode()
 
 	return authorization
@@ -47,51 +69,114 @@ func (o OAuth2) AuthorizationURL() *url.URL {
 
 // AccessTokenURL returns the URL and POST form to exchange an authorization code
 // to an access token
-func (o OAuth2) AccessTokenURL(code string) (*url.URL, url.Values) {
-	token, _ := url.Parse(o.API)
-	token.Path = "/oauth2/token"
-
+func (o OAuth2) AccessTokenURL(code string, codeVerifier string) (*url.URL, url.Values) {
 	form := make(url.Values)
 	form.Set("code", code)
 	form.Set("grant_type", "authorization_code")
-	form.Set("client_id", o.ClientID)
-	form.Set("client_secret", o.ClientSecret)
+	form.Set("code_verifier", codeVerifier)
+	if o.RedirectURI != "" {
+		form.Set("redirect_uri", o.RedirectURI)
+	}
 
-	return token, form
+	return o.tokenURL(form)
+}
+
+// RefreshTokenURL returns the URL and POST form to exchange a refresh token to a
+// new access token
+func (o OAuth2) RefreshTokenURL(refreshToken string) (*url.URL, url.Values) {
+	form := make(url.Values)
+	form.Set("refresh_token", refreshToken)
+	form.Set("grant_type", "refresh_token")
+
+	return o.tokenURL(form)
+}
+
+// GetAccessToken exchanges an authorization code for an access token and a refresh token
+func (o OAuth2) GetAccessToken(ctx context.Context, code string, codeVerifier string) (*Token, error) {
+	url, form := o.AccessTokenURL(code, codeVerifier)
+
+	return o.requestToken(ctx, url, form)
+}
+
+// RefreshAccessToken exchanges a refresh token for a new access token
+func (o OAuth2) RefreshAccessToken(ctx context.Context, refreshToken string) (*Token, error) {
+	url, form := o.RefreshTokenURL(refreshToken)
+
+	token, err := o.requestToken(ctx, url, form)
+	if err != nil {
+		return nil, err
+	}
+
+	if token.RefreshToken == "" {
+		token.RefreshToken = refreshToken
+	}
+
+	return token, nil
 }
 
-// GetAccessToken exchanges an authorization code for an access token
-func (o OAuth2) GetAccessToken(code string) (string, error) {
-	var client http.Client
+// randomString returns 32 random bytes encoded for URLs
+func randomString() (string, error) {
+	random := make([]byte, 32)
 
-	url, form := o.AccessTokenURL(code)
+	_, err := rand.Read(random)
+	if err != nil {
+		return "", errors.Wrap(err, "can't generate random value")
+	}
+
+	return base64.RawURLEncoding.EncodeToString(random), nil
+}
+
+func (o OAuth2) tokenURL(form url.Values) (*url.URL, url.Values) {
+	token, _ := url.Parse(o.API)
+	token.Path = "/oauth2/token"
 
+	form.Set("client_id", o.ClientID)
+	if o.ClientSecret != "" {
+		form.Set("client_secret", o.ClientSecret)
+	}
+
+	return token, form
+}
+
+func (o OAuth2) requestToken(ctx context.Context, url *url.URL, form url.Values) (*Token, error) {
 	postBody := strings.NewReader(form.Encode())
 	request, err := http.NewRequest("POST", url.String(), postBody)
 	if err != nil {
-		return "", errors.Wrap(err, "can't build access token request")
+		return nil, errors.Wrap(err, "can't build access token request")
 	}
+	request = request.WithContext(ctx)
 	request.Header.Add("Content-Type", "application/x-www-form-urlencoded")
 
+	client := o.HTTPClient
+	if client == nil {
+		client = http.DefaultClient
+	}
+
 	response, err := client.Do(request)
 	if err != nil {
-		return "", errors.Wrap(err, "can't execute access token request")
+		return nil, errors.Wrap(err, "can't execute access token request")
 	}
+	defer response.Body.Close()
 
 	body, err := ioutil.ReadAll(response.Body)
 	if err != nil {
-		return "", errors.Wrap(err, "can't read access token response")
+		return nil, errors.Wrap(err, "can't read access token response")
 	}
 
 	if response.StatusCode != 200 {
-		return "", fmt.Errorf("error exchanging token. detail: %s", body)
+		return nil, errors.Wrap(&Error{Body: body, StatusCode: response.StatusCode}, "error exchanging token")
 	}
 
 	var accessToken internal.AccessTokenResponse
 	err = json.Unmarshal(body, &accessToken)
 	if err != nil {
-		return "", errors.Wrap(err, "can't parse access token response")
+		return nil, errors.Wrap(err, "can't parse access token response")
+	}
+
+	token := &Token{AccessToken: accessToken.Token, RefreshToken: accessToken.RefreshToken}
+	if accessToken.ExpiresIn > 0 {
+		token.ExpiresAt = time.Now().Add(time.Duration(accessToken.ExpiresIn) * time.Second)
 	}
 
-	return accessToken.Token, nil
+	return token, nil
 }
@@ -1,41 +1,72 @@
 package dropbox
 
 import (
+	"context"
 	"encoding/json"
 	"strings"
 	"sync"
 
 	"github.com/kdisneur/dropbox_sync/pkg/dropbox/internal"
+	"github.com/kdisneur/dropbox_sync/pkg/ignore"
 	"github.com/pkg/errors"
 	"github.com/sirupsen/logrus"
 )
 
+// CursorStore persists the position of a scanner in the Dropbox changes so a
+// restarted scanner can resume from it
+type CursorStore interface {
+	Cursor() string
+	SetCursor(cursor string) error
+}
+
 // Scanner represents a paginated list of entries
 type Scanner struct {
 	Client      Client
 	buffer      []Action
+	cursors     CursorStore
 	err         error
 	hasNextPage *bool
 	index       int
+	idPaths     map[string]string
+	matcher     *ignore.Matcher
 	mutex       sync.Mutex
 	nextCursor  string
 	path        string
 	logger      *logrus.Entry
 }
 
-// NewScanner creates a new folder scanner
-func NewScanner(logger *logrus.Entry, client Client, path string) *Scanner {
-	return &Scanner{Client: client, logger: logger, path: path}
+// NewScanner creates a new folder scanner. The cursor is saved in the cursor
+// store, when not nil, each time a page of changes has been processed. Ignored
+// paths are never reported
+func NewScanner(logger *logrus.Entry, client Client, path string, cursors CursorStore, matcher *ignore.Matcher) *Scanner {
+	return &Scanner{
+		Client:  client,
+		cursors: cursors,
+		idPaths: make(map[string]string),
+		logger:  logger,
+		matcher: matcher,
+		path:    path,
+	}
 }
 
 // Next replace the `Entry` with the following one if it can and return false if it can't
-func (f *Scanner) Next() bool {
+func (f *Scanner) Next(ctx context.Context) bool {
 	if f.Err() != nil {
 		return false
 	}
 
+	if ctx.Err() != nil {
+		f.err = ctx.Err()
+		return false
+	}
+
 	if f.buffer == nil {
-		return f.loadFirstPage()
+		if f.savedCursor() == "" {
+			return f.loadFirstPage(ctx)
+		}
+
+		f.nextCursor = f.savedCursor()
+		f.buffer = []Action{}
 	}
 
 	nextIndex := f.index + 1
@@ -44,21 +75,113 @@ func (f *Scanner) Next() bool {
 		return true
 	}
 
+	err := f.saveCursor()
+	if err != nil {
+		f.err = err
+		return false
+	}
+
 	if f.hasNextPage != nil && !*f.hasNextPage {
-		err := f.waitForUpdate()
+		err := f.waitForUpdate(ctx)
 		if err != nil {
 			f.err = err
 			return false
 		}
 	}
 
-	if !f.loadNextPage() {
-		return f.Next()
+	if !f.loadNextPage(ctx) {
+		return f.Next(ctx)
 	}
 
 	return true
 }
 
+// InitialListing fetches every page of the first folder listing and returns the
+// files it contains. Following calls to `Next` only return later changes
+func (f *Scanner) InitialListing(ctx context.Context) ([]File, error) {
+	var files []File
+
+	f.err = nil
+	f.nextCursor = ""
+
+	hasPage := f.loadFirstPage(ctx)
+	for f.Err() == nil {
+		if hasPage {
+			for _, action := range f.buffer {
+				files = append(files, action.File)
+			}
+		}
+
+		if !*f.hasNextPage {
+			break
+		}
+
+		hasPage = f.loadNextPage(ctx)
+	}
+
+	if f.Err() != nil {
+		return nil, f.Err()
+	}
+
+	f.buffer = []Action{}
+	f.index = 0
+
+	return files, nil
+}
+
+// ResumeListing fetches every change done since the cursor saved by the last run.
+// It reports false when no cursor has been saved or when Dropbox reset it, in
+// which case the folder has to be listed again with `InitialListing`. Following
+// calls to `Next` only return later changes
+func (f *Scanner) ResumeListing(ctx context.Context) ([]Action, bool, error) {
+	cursor := f.savedCursor()
+	if cursor == "" {
+		return nil, false, nil
+	}
+
+	var actions []Action
+
+	f.err = nil
+	f.nextCursor = cursor
+	for {
+		hasPage := f.loadNextPage(ctx)
+		if IsReset(f.Err()) {
+			f.logger.Warnf("Dropbox cursor has been reset")
+			f.err = nil
+			f.nextCursor = ""
+
+			return nil, false, errors.Wrap(f.cursors.SetCursor(""), "can't save Dropbox cursor")
+		}
+
+		if f.Err() != nil {
+			return nil, false, f.Err()
+		}
+
+		if hasPage {
+			actions = append(actions, f.buffer...)
+		}
+
+		if !*f.hasNextPage {
+			break
+		}
+	}
+
+	f.buffer = []Action{}
+	f.index = 0
+
+	return actions, true, nil
+}
+
+// Remember records files already known, for instance from a previous run, so
+// their later moves are detected
+func (f *Scanner) Remember(files []File) {
+	for _, file := range files {
+		if file.ID != "" {
+			f.idPaths[file.ID] = file.RelativePath
+		}
+	}
+}
+
 // Entry returns the current scanner content
 func (f *Scanner) Entry() *Action {
 	if f.Err() != nil {
@@ -77,13 +200,31 @@ func (f *Scanner) Err() error {
 	return f.err
 }
 
-func (f *Scanner) loadFirstPage() bool {
+func (f *Scanner) savedCursor() string {
+	if f.cursors == nil {
+		return ""
+	}
+
+	return f.cursors.Cursor()
+}
+
+// saveCursor records that every change up to the current cursor has been processed
+func (f *Scanner) saveCursor() error {
+	if f.cursors == nil || f.nextCursor == "" || f.nextCursor == f.cursors.Cursor() {
+		return nil
+	}
+
+	return errors.Wrap(f.cursors.SetCursor(f.nextCursor), "can't save Dropbox cursor")
+}
+
+func (f *Scanner) loadFirstPage(ctx context.Context) bool {
 	f.logger.WithFields(logrus.Fields{"cursor": f.nextCursor}).Debugf("fetch first page of entries")
 
 	return f.executeQuery(func() ([]byte, error) {
 		return internal.POSTWithBody(
-			"https://api.dropboxapi.com/2/files/list_folder",
-			f.Client.token,
+			ctx,
+			f.Client.session(),
+			f.Client.Endpoints.api("/2/files/list_folder"),
 			map[string]interface{}{
 				"path":                    f.path,
 				"recursive":               true,
@@ -95,13 +236,14 @@ func (f *Scanner) loadFirstPage() bool {
 	})
 }
 
-func (f *Scanner) loadNextPage() bool {
+func (f *Scanner) loadNextPage(ctx context.Context) bool {
 	f.logger.WithFields(logrus.Fields{"cursor": f.nextCursor}).Debugf("fetch next page of entries")
 
 	return f.executeQuery(func() ([]byte, error) {
 		return internal.POSTWithBody(
-			"https://api.dropboxapi.com/2/files/list_folder/continue",
-			f.Client.token,
+			ctx,
+			f.Client.session(),
+			f.Client.Endpoints.api("/2/files/list_folder/continue"),
 			map[string]interface{}{"cursor": f.nextCursor},
 		)
 	})
@@ -141,15 +283,105 @@ func (f *Scanner) executeQuery(postFunc func() ([]byte, error)) bool {
 		f.buffer[i] = Action{Type: actionType, File: *file}
 	}
 
+	f.buffer = f.skipIgnored(f.pairMoves(f.buffer))
+
 	return len(f.buffer) > 0
 }
 
-func (f *Scanner) waitForUpdate() error {
+// skipIgnored drops the actions on ignored paths. A move from an ignored path
+// becomes a creation and a move to an ignored path becomes a deletion
+func (f *Scanner) skipIgnored(actions []Action) []Action {
+	kept := actions[:0]
+	for _, action := range actions {
+		ignored := f.isIgnored(action.Type, action.File)
+
+		if action.Type == ActionTypeMove {
+			sourceIgnored := f.isIgnored(action.Type, action.Source)
+
+			switch {
+			case sourceIgnored && !ignored:
+				action = Action{Type: ActionTypeCreate, File: action.File}
+			case !sourceIgnored && ignored:
+				action = Action{Type: ActionTypeDelete, File: action.Source}
+				ignored = false
+			}
+		}
+
+		if ignored {
+			f.logger.Debugf("ignored path. skip (%s)", action.File.RelativePath)
+			continue
+		}
+
+		kept = append(kept, action)
+	}
+
+	return kept
+}
+
+// isIgnored reports whether a file matches the ignore rules. The type of deleted
+// files is unknown so they are ignored when they would be either as a file or as a folder
+func (f *Scanner) isIgnored(actionType internal.ActionType, file File) bool {
+	if actionType == ActionTypeDelete {
+		return f.matcher.MatchAny(file.RelativePath)
+	}
+
+	return f.matcher.Match(file.RelativePath, file.Type == FileTypeFolder)
+}
+
+// pairMoves replaces a deletion and a creation of the same entry ID by a single
+// move. Dropbox reports a move as a deletion of the old path and a new entry
+func (f *Scanner) pairMoves(actions []Action) []Action {
+	deletions := make(map[string]int)
+	for i, action := range actions {
+		if action.Type == ActionTypeDelete {
+			deletions[action.File.RelativePath] = i
+		}
+	}
+
+	paired := make(map[int]bool)
+	for i, action := range actions {
+		if action.Type != ActionTypeCreate || action.File.ID == "" {
+			continue
+		}
+
+		previousPath, known := f.idPaths[action.File.ID]
+		f.idPaths[action.File.ID] = action.File.RelativePath
+
+		deletion, deleted := deletions[previousPath]
+		if !known || previousPath == action.File.RelativePath || !deleted || paired[deletion] {
+			continue
+		}
+
+		source := actions[deletion].File
+		source.ID = action.File.ID
+		source.Type = action.File.Type
+
+		actions[i] = Action{Type: ActionTypeMove, File: action.File, Source: source}
+		paired[deletion] = true
+	}
+
+	if len(paired) == 0 {
+		return actions
+	}
+
+	remaining := make([]Action, 0, len(actions)-len(paired))
+	for i, action := range actions {
+		if !paired[i] {
+			remaining = append(remaining, action)
+		}
+	}
+
+	return remaining
+}
+
+func (f *Scanner) waitForUpdate(ctx context.Context) error {
 	timeout := 30 // seconds
 	f.logger.Debugf("wait for new updates (timeout: %d seconds)", timeout)
 
 	body, err := internal.UnuathenticatedPOSTWithBody(
-		"https://notify.dropboxapi.com/2/files/list_folder/longpoll",
+		ctx,
+		f.Client.session(),
+		f.Client.Endpoints.notify("/2/files/list_folder/longpoll"),
 		map[string]interface{}{"cursor": f.nextCursor, "timeout": timeout},
 	)
 
@@ -166,7 +398,7 @@ func (f *Scanner) waitForUpdate() error {
 	if !response.NewFilesAvailable {
 		f.logger.Debugf("no new files available")
 
-		return f.waitForUpdate()
+		return f.waitForUpdate(ctx)
 	}
 
 	f.logger.Debugf("new files available")
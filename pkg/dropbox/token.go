@@ -0,0 +1,76 @@
+package dropbox
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/kdisneur/dropbox_sync/pkg/dropbox/internal"
+	"github.com/pkg/errors"
+)
+
+// tokenRenewalMargin is how long before its expiry an access token is renewed
+const tokenRenewalMargin = time.Minute
+
+// Token represents the credentials given by Dropbox. Legacy long-lived access
+// tokens have neither refresh token nor expiry
+type Token struct {
+	AccessToken  string    `json:"access_token"`
+	ExpiresAt    time.Time `json:"expires_at"`
+	RefreshToken string    `json:"refresh_token,omitempty"`
+}
+
+// tokenSource shares an access token between the copies of a client and renews
+// it with the refresh token
+type tokenSource struct {
+	mutex  sync.Mutex
+	oauth2 OAuth2
+	save   func(Token) error
+	token  Token
+}
+
+// Token returns the access token, renewed first when it is about to expire
+func (t *tokenSource) Token(ctx context.Context) (string, error) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	if t.token.RefreshToken == "" || t.token.ExpiresAt.IsZero() || time.Until(t.token.ExpiresAt) > tokenRenewalMargin {
+		return t.token.AccessToken, nil
+	}
+
+	return t.renew(ctx)
+}
+
+// Refresh renews the access token rejected by Dropbox, unless another request
+// already renewed it
+func (t *tokenSource) Refresh(ctx context.Context, rejected string) (string, error) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	if t.token.AccessToken != rejected {
+		return t.token.AccessToken, nil
+	}
+
+	return t.renew(ctx)
+}
+
+func (t *tokenSource) renew(ctx context.Context) (string, error) {
+	if t.token.RefreshToken == "" {
+		return "", internal.ErrNoRefreshToken
+	}
+
+	renewed, err := t.oauth2.RefreshAccessToken(ctx, t.token.RefreshToken)
+	if err != nil {
+		return "", errors.Wrap(err, "can't renew Dropbox access token")
+	}
+	t.token = *renewed
+
+	if t.save != nil {
+		err = t.save(t.token)
+		if err != nil {
+			return "", errors.Wrap(err, "can't save renewed Dropbox access token")
+		}
+	}
+
+	return t.token.AccessToken, nil
+}
@@ -0,0 +1,207 @@
+package dropbox
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+
+	"github.com/kdisneur/dropbox_sync/pkg/dropbox/internal"
+	"github.com/pkg/errors"
+)
+
+// UploadChunkSize is the size of the chunks sent by `FileUploadStream`. It must
+// be a multiple of 4MB, as required by Dropbox upload sessions
+const UploadChunkSize = 2 * ContentHashBlockSize
+
+// uploadChunkAttempts is how many times a chunk partially received by Dropbox is sent again
+const uploadChunkAttempts = 5
+
+// FileUploadStream uploads the content of a reader to Dropbox and returns its new
+// metadata. Content bigger than a chunk goes through an upload session which
+// resumes from the last acknowledged offset after a failure. The content hash is
+// computed while reading and checked against the one Dropbox computed
+func FileUploadStream(ctx context.Context, client Client, remotePath string, reader io.Reader, mode WriteMode) (*File, error) {
+	upload := &uploadSession{client: client, hasher: NewContentHasher(), reader: reader}
+
+	chunk, last, err := upload.readChunk()
+	if err != nil {
+		return nil, err
+	}
+
+	var file *File
+	if last {
+		file, err = FileUpload(ctx, client, remotePath, chunk, mode)
+	} else {
+		file, err = upload.send(ctx, chunk, remotePath, mode)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	if file.ContentHash != upload.hasher.Sum() {
+		return nil, errors.Errorf("content hash mismatch after uploading '%s'", remotePath)
+	}
+
+	return file, nil
+}
+
+// uploadSession represents a file being uploaded in several chunks
+type uploadSession struct {
+	client    Client
+	hasher    *ContentHasher
+	offset    int64
+	reader    io.Reader
+	sessionID string
+}
+
+// readChunk reads the next chunk and reports whether it is the last one
+func (u *uploadSession) readChunk() ([]byte, bool, error) {
+	chunk := make([]byte, UploadChunkSize)
+
+	n, err := io.ReadFull(u.reader, chunk)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		u.hasher.Write(chunk[:n])
+		return chunk[:n], true, nil
+	}
+
+	if err != nil {
+		return nil, false, errors.Wrap(err, "can't read upload content")
+	}
+
+	u.hasher.Write(chunk)
+
+	return chunk, false, nil
+}
+
+func (u *uploadSession) send(ctx context.Context, chunk []byte, remotePath string, mode WriteMode) (*File, error) {
+	err := u.sendChunk(chunk, func(data []byte) ([]byte, error) {
+		return internal.POSTWithDataHeadersAndBinary(
+			ctx,
+			u.client.session(),
+			u.client.Endpoints.content("/2/files/upload_session/start"),
+			map[string]interface{}{"close": false},
+			data,
+		)
+	})
+
+	if err != nil {
+		return nil, errors.Wrap(err, "can't start upload session")
+	}
+
+	for {
+		next, last, err := u.readChunk()
+		if err != nil {
+			return nil, err
+		}
+
+		if last {
+			return u.finish(ctx, next, remotePath, mode)
+		}
+
+		err = u.sendChunk(next, func(data []byte) ([]byte, error) {
+			return internal.POSTWithDataHeadersAndBinary(
+				ctx,
+				u.client.session(),
+				u.client.Endpoints.content("/2/files/upload_session/append_v2"),
+				map[string]interface{}{"cursor": u.cursor(), "close": false},
+				data,
+			)
+		})
+
+		if err != nil {
+			return nil, errors.Wrap(err, "can't append to upload session")
+		}
+	}
+}
+
+func (u *uploadSession) finish(ctx context.Context, chunk []byte, remotePath string, mode WriteMode) (*File, error) {
+	var body []byte
+	err := u.sendChunk(chunk, func(data []byte) ([]byte, error) {
+		var err error
+		body, err = internal.POSTWithDataHeadersAndBinary(
+			ctx,
+			u.client.notIdempotentSession(),
+			u.client.Endpoints.content("/2/files/upload_session/finish"),
+			map[string]interface{}{
+				"cursor": u.cursor(),
+				"commit": map[string]interface{}{"path": remotePath, "mode": mode.value(), "autorename": mode.autorename, "mute": false},
+			},
+			data,
+		)
+
+		return body, err
+	})
+
+	if err != nil {
+		return nil, errors.Wrap(err, "can't finish upload session")
+	}
+
+	response := &internal.FileMetadataResponse{}
+	err = json.Unmarshal(body, response)
+	if err != nil {
+		return nil, err
+	}
+
+	return fileFromAPI(response), nil
+}
+
+// sendChunk sends a chunk until Dropbox acknowledges it. Transient failures are
+// retried by the client; when Dropbox already received part of the chunk, only
+// the remaining bytes are sent again
+func (u *uploadSession) sendChunk(chunk []byte, post func([]byte) ([]byte, error)) error {
+	start := u.offset
+	end := u.offset + int64(len(chunk))
+
+	var err error
+	for attempt := 0; attempt < uploadChunkAttempts; attempt++ {
+		var body []byte
+		body, err = post(chunk[u.offset-start:])
+		if err == nil {
+			if u.sessionID == "" {
+				var response internal.UploadSessionStartResponse
+				err = json.Unmarshal(body, &response)
+				if err != nil {
+					return errors.Wrap(err, "can't parse upload session")
+				}
+				u.sessionID = response.SessionID
+			}
+
+			u.offset = end
+			return nil
+		}
+
+		correctOffset, ok := incorrectOffset(err)
+		if !ok || correctOffset < start || correctOffset > end {
+			return err
+		}
+
+		u.offset = correctOffset
+	}
+
+	return err
+}
+
+func (u *uploadSession) cursor() map[string]interface{} {
+	return map[string]interface{}{"session_id": u.sessionID, "offset": u.offset}
+}
+
+// incorrectOffset returns the offset Dropbox expected when it rejects a chunk
+func incorrectOffset(err error) (int64, bool) {
+	apiErr, ok := errors.Cause(err).(*internal.APIError)
+	if !ok {
+		return 0, false
+	}
+
+	var response internal.UploadSessionErrorResponse
+	if json.Unmarshal(apiErr.Body, &response) != nil {
+		return 0, false
+	}
+
+	lookup := response.Error.UploadSessionLookupError
+	if response.Error.LookupFailed != nil {
+		lookup = *response.Error.LookupFailed
+	}
+
+	return lookup.CorrectOffset, lookup.Tag == "incorrect_offset"
+}
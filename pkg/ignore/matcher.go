@@ -0,0 +1,350 @@
+package ignore
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// FileName is the name of the files listing ignored paths in their folder and
+// below, with the gitignore syntax
+const FileName = ".dropboxignore"
+
+// ReservedFolder is the folder, at the root of each synchronized folder, holding
+// the files of the synchronizer itself. It is always ignored
+const ReservedFolder = ".dropbox_sync"
+
+// Matcher represents gitignore-style rules deciding which paths are never
+// synchronized. Rules come from a list of patterns applying to the whole tree and
+// from the ignore files found in the local folder, loaded when first needed.
+// Paths left out of the selective sync are ignored as well
+type Matcher struct {
+	changed   chan struct{}
+	folders   map[string][]rule
+	mutex     sync.Mutex
+	patterns  []string
+	root      string
+	rules     []rule
+	selection Selection
+}
+
+// rule represents a single pattern
+type rule struct {
+	folderOnly bool
+	negated    bool
+	pattern    *regexp.Regexp
+}
+
+// NewMatcher creates a matcher from patterns applying to the whole tree, from
+// the ignore files found below the local root folder and from the selective sync
+func NewMatcher(root string, patterns []string, selection Selection) (*Matcher, error) {
+	m := &Matcher{
+		changed:   make(chan struct{}, 1),
+		folders:   make(map[string][]rule),
+		patterns:  patterns,
+		root:      root,
+		selection: selection,
+	}
+
+	for _, pattern := range patterns {
+		r, ok, err := parseRule(pattern)
+		if err != nil {
+			return nil, errors.Wrapf(err, "can't parse ignore pattern '%s'", pattern)
+		}
+
+		if ok {
+			m.rules = append(m.rules, r)
+		}
+	}
+
+	return m, nil
+}
+
+// Match reports whether a path, relative to the root folder, is ignored. A path
+// is ignored as well when one of its parent folders is
+func (m *Matcher) Match(relativePath string, folder bool) bool {
+	parts := strings.Split(strings.Trim(relativePath, "/"), "/")
+	if parts[0] == ReservedFolder {
+		return true
+	}
+
+	if m == nil || parts[0] == "" {
+		return false
+	}
+
+	if !m.selection.Selected(relativePath) {
+		return true
+	}
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	for i := range parts {
+		isFolder := folder || i < len(parts)-1
+		if m.matchOne(parts[:i+1], isFolder) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// MatchAny reports whether a path is ignored either as a file or as a folder. It
+// is meant for deleted paths whose type is unknown
+func (m *Matcher) MatchAny(relativePath string) bool {
+	return m.Match(relativePath, false) || m.Match(relativePath, true)
+}
+
+// Selected reports whether a path is part of the selective sync
+func (m *Matcher) Selected(relativePath string) bool {
+	if m == nil {
+		return true
+	}
+
+	return m.selection.Selected(relativePath)
+}
+
+// Selection returns the selective sync
+func (m *Matcher) Selection() Selection {
+	if m == nil {
+		return Selection{}
+	}
+
+	return m.selection
+}
+
+// Reload reads again the ignore file of a folder, relative to the root folder,
+// after it has been created, changed or deleted
+func (m *Matcher) Reload(relativeFolder string) {
+	if m == nil {
+		return
+	}
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	delete(m.folders, strings.Trim(relativeFolder, "/"))
+
+	select {
+	case m.changed <- struct{}{}:
+	default:
+	}
+}
+
+// Changed returns a channel receiving a value after an ignore file has been reloaded
+func (m *Matcher) Changed() <-chan struct{} {
+	if m == nil {
+		return nil
+	}
+
+	return m.changed
+}
+
+// Fingerprint returns a digest of the patterns and of the content of every ignore
+// file below the root folder, so a change of the rules can be detected. It is
+// empty when there is no rule at all
+func (m *Matcher) Fingerprint() string {
+	if m == nil {
+		return ""
+	}
+
+	digest := sha256.New()
+	empty := len(m.patterns) == 0
+
+	for _, pattern := range m.patterns {
+		fmt.Fprintf(digest, "%s\n", pattern)
+	}
+
+	filepath.Walk(m.root, func(filePath string, info os.FileInfo, err error) error {
+		if err != nil {
+			return nil
+		}
+
+		if info.IsDir() && filePath == filepath.Join(m.root, ReservedFolder) {
+			return filepath.SkipDir
+		}
+
+		if info.IsDir() || info.Name() != FileName {
+			return nil
+		}
+
+		content, err := ioutil.ReadFile(filePath)
+		if err != nil {
+			return nil
+		}
+
+		empty = false
+		fmt.Fprintf(digest, "\x00%s\x00%d\x00", strings.TrimPrefix(filePath, m.root), len(content))
+		digest.Write(content)
+
+		return nil
+	})
+
+	if empty {
+		return ""
+	}
+
+	return fmt.Sprintf("%x", digest.Sum(nil))
+}
+
+// IsIgnoreFile reports whether a path is an ignore file
+func IsIgnoreFile(filePath string) bool {
+	return path.Base(filePath) == FileName
+}
+
+// matchOne applies the rules to a single path. The last matching rule wins and
+// the rules of deeper ignore files win over the shallower ones
+func (m *Matcher) matchOne(parts []string, folder bool) bool {
+	ignored := false
+
+	apply := func(rules []rule, relativePath string) {
+		for _, r := range rules {
+			if r.folderOnly && !folder {
+				continue
+			}
+
+			if r.pattern.MatchString(relativePath) {
+				ignored = !r.negated
+			}
+		}
+	}
+
+	apply(m.rules, strings.Join(parts, "/"))
+	for i := 0; i < len(parts); i++ {
+		folderPath := strings.Join(parts[:i], "/")
+		apply(m.folderRules(folderPath), strings.Join(parts[i:], "/"))
+	}
+
+	return ignored
+}
+
+// folderRules returns the rules of the ignore file of a folder. The mutex must be held
+func (m *Matcher) folderRules(folderPath string) []rule {
+	rules, loaded := m.folders[folderPath]
+	if loaded {
+		return rules
+	}
+
+	content, err := ioutil.ReadFile(path.Join(m.root, folderPath, FileName))
+	if err == nil {
+		rules = parseRules(content)
+	}
+
+	m.folders[folderPath] = rules
+
+	return rules
+}
+
+// parseRules parses the content of an ignore file. Invalid patterns are skipped, as git does
+func parseRules(content []byte) []rule {
+	var rules []rule
+
+	scanner := bufio.NewScanner(bytes.NewReader(content))
+	for scanner.Scan() {
+		r, ok, err := parseRule(scanner.Text())
+		if err == nil && ok {
+			rules = append(rules, r)
+		}
+	}
+
+	return rules
+}
+
+// parseRule parses a single pattern and reports false for blank lines and comments
+// https://git-scm.com/docs/gitignore#_pattern_format
+func parseRule(line string) (rule, bool, error) {
+	var r rule
+
+	line = strings.TrimRight(strings.TrimSuffix(line, "\r"), " ")
+	if line == "" || strings.HasPrefix(line, "#") {
+		return r, false, nil
+	}
+
+	if strings.HasPrefix(line, "!") {
+		r.negated = true
+		line = line[1:]
+	} else if strings.HasPrefix(line, `\!`) || strings.HasPrefix(line, `\#`) {
+		line = line[1:]
+	}
+
+	if strings.HasSuffix(line, "/") {
+		r.folderOnly = true
+		line = strings.TrimRight(line, "/")
+	}
+
+	if line == "" {
+		return r, false, nil
+	}
+
+	anchored := strings.Contains(line, "/")
+	line = strings.TrimPrefix(line, "/")
+
+	expression := globToRegexp(line)
+	if !anchored {
+		expression = "(?:.*/)?" + expression
+	}
+
+	pattern, err := regexp.Compile("^" + expression + "$")
+	if err != nil {
+		return r, false, err
+	}
+	r.pattern = pattern
+
+	return r, true, nil
+}
+
+// globToRegexp translates a gitignore glob. Wildcards don't match a slash, except
+// the `**` ones matching any number of folders
+func globToRegexp(glob string) string {
+	var expression strings.Builder
+
+	for i := 0; i < len(glob); i++ {
+		c := glob[i]
+
+		switch {
+		case strings.HasPrefix(glob[i:], "**/"):
+			expression.WriteString("(?:.*/)?")
+			i += 2
+		case strings.HasPrefix(glob[i:], "/**") && i+3 == len(glob):
+			expression.WriteString("/.*")
+			i += 2
+		case strings.HasPrefix(glob[i:], "**"):
+			expression.WriteString(".*")
+			i++
+		case c == '*':
+			expression.WriteString("[^/]*")
+		case c == '?':
+			expression.WriteString("[^/]")
+		case c == '[':
+			end := strings.IndexByte(glob[i+1:], ']')
+			if end < 0 {
+				expression.WriteString(`\[`)
+				continue
+			}
+
+			class := glob[i+1 : i+1+end]
+			if strings.HasPrefix(class, "!") {
+				class = "^" + class[1:]
+			}
+			expression.WriteString("[" + strings.Replace(class, `\`, `\\`, -1) + "]")
+			i += end + 1
+		case c == '\\' && i+1 < len(glob):
+			i++
+			expression.WriteString(regexp.QuoteMeta(string(glob[i])))
+		default:
+			expression.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+
+	return expression.String()
+}
@@ -0,0 +1,179 @@
+package ignore_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/kdisneur/dropbox_sync/pkg/ignore"
+)
+
+func TestMatchPatterns(t *testing.T) {
+	tests := []struct {
+		patterns []string
+		path     string
+		folder   bool
+		ignored  bool
+	}{
+		{[]string{"*.log"}, "/a.log", false, true},
+		{[]string{"*.log"}, "/dir/a.log", false, true},
+		{[]string{"*.log"}, "/a.log.txt", false, false},
+		{[]string{"/build"}, "/build", true, true},
+		{[]string{"/build"}, "/build/output.bin", false, true},
+		{[]string{"/build"}, "/src/build", true, false},
+		{[]string{"docs/*.md"}, "/docs/a.md", false, true},
+		{[]string{"docs/*.md"}, "/docs/sub/a.md", false, false},
+		{[]string{"docs/*.md"}, "/src/docs/a.md", false, false},
+		{[]string{"tmp/"}, "/tmp", true, true},
+		{[]string{"tmp/"}, "/tmp", false, false},
+		{[]string{"tmp/"}, "/src/tmp", true, true},
+		{[]string{"**/cache"}, "/cache", true, true},
+		{[]string{"**/cache"}, "/a/b/cache", false, true},
+		{[]string{"logs/**"}, "/logs/a/b.txt", false, true},
+		{[]string{"logs/**"}, "/logs", true, false},
+		{[]string{"a/**/b"}, "/a/b", false, true},
+		{[]string{"a/**/b"}, "/a/x/y/b", false, true},
+		{[]string{"a/**/b"}, "/a/x/y/c", false, false},
+		{[]string{"file?.txt"}, "/file1.txt", false, true},
+		{[]string{"file?.txt"}, "/file10.txt", false, false},
+		{[]string{"[abc].txt"}, "/a.txt", false, true},
+		{[]string{"[abc].txt"}, "/d.txt", false, false},
+		{[]string{"[!abc].txt"}, "/d.txt", false, true},
+		{[]string{"[!abc].txt"}, "/a.txt", false, false},
+		{[]string{"[unclosed"}, "/[unclosed", false, true},
+		{[]string{"a+b(c).txt"}, "/a+b(c).txt", false, true},
+		{[]string{`a\*b`}, "/a*b", false, true},
+		{[]string{`a\*b`}, "/axb", false, false},
+		{[]string{`\#hash`}, "/#hash", false, true},
+		{[]string{`\!bang`}, "/!bang", false, true},
+		{[]string{"# comment"}, "/# comment", false, false},
+		{[]string{"trailing   "}, "/trailing", false, true},
+		{[]string{"*.log", "!keep.log"}, "/keep.log", false, false},
+		{[]string{"*.log", "!keep.log"}, "/other.log", false, true},
+		{[]string{"!keep.log", "*.log"}, "/keep.log", false, true},
+		{nil, "/" + ignore.ReservedFolder + "/state.db", false, true},
+		{nil, "/file.txt", false, false},
+	}
+
+	root := emptyFolder(t)
+	defer os.RemoveAll(root)
+
+	for _, test := range tests {
+		matcher, err := ignore.NewMatcher(root, test.patterns, ignore.Selection{})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if ignored := matcher.Match(test.path, test.folder); ignored != test.ignored {
+			t.Errorf("expected %v to ignore '%s' (folder: %t): %t, got %t", test.patterns, test.path, test.folder, test.ignored, ignored)
+		}
+	}
+}
+
+func TestMatchIgnoreFiles(t *testing.T) {
+	root := emptyFolder(t)
+	defer os.RemoveAll(root)
+
+	writeFile(t, root, ignore.FileName, "*.txt\n!readme.md\n")
+	writeFile(t, root, "sub/"+ignore.FileName, "!keep.txt\n")
+
+	matcher, err := ignore.NewMatcher(root, []string{"*.md"}, ignore.NewSelection(nil, []string{"/private"}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		path    string
+		ignored bool
+	}{
+		{"/notes.txt", true},
+		{"/sub/notes.txt", true},
+		{"/sub/keep.txt", false},
+		{"/keep.txt", true},
+		{"/readme.md", false},
+		{"/sub/readme.md", false},
+		{"/changes.md", true},
+		{"/private/file.bin", true},
+		{"/public/file.bin", false},
+	}
+
+	for _, test := range tests {
+		if ignored := matcher.Match(test.path, false); ignored != test.ignored {
+			t.Errorf("expected '%s' to be ignored: %t, got %t", test.path, test.ignored, ignored)
+		}
+	}
+
+	if !matcher.MatchAny("/notes.txt") || matcher.MatchAny("/notes.bin") {
+		t.Errorf("expected deleted paths to be ignored when they would be as a file or as a folder")
+	}
+}
+
+func TestReloadAndFingerprint(t *testing.T) {
+	root := emptyFolder(t)
+	defer os.RemoveAll(root)
+
+	matcher, err := ignore.NewMatcher(root, nil, ignore.Selection{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if fingerprint := matcher.Fingerprint(); fingerprint != "" {
+		t.Fatalf("expected no fingerprint without rules, got %s", fingerprint)
+	}
+
+	writeFile(t, root, "sub/"+ignore.FileName, "*.tmp\n")
+	if !matcher.Match("/sub/a.tmp", false) {
+		t.Fatalf("expected a new ignore file to be loaded when first needed")
+	}
+	first := matcher.Fingerprint()
+
+	writeFile(t, root, "sub/"+ignore.FileName, "*.bak\n")
+	if matcher.Match("/sub/a.bak", false) {
+		t.Fatalf("expected the rules to be kept until reloaded")
+	}
+
+	matcher.Reload("/sub")
+
+	select {
+	case <-matcher.Changed():
+	default:
+		t.Fatalf("expected a reload to be notified")
+	}
+
+	if !matcher.Match("/sub/a.bak", false) || matcher.Match("/sub/a.tmp", false) {
+		t.Fatalf("expected the rules to be reloaded")
+	}
+
+	second := matcher.Fingerprint()
+	if second == "" || second == first {
+		t.Fatalf("expected the fingerprint to change with the rules, got %s then %s", first, second)
+	}
+
+	writeFile(t, root, ignore.ReservedFolder+"/"+ignore.FileName, "*\n")
+	if third := matcher.Fingerprint(); third != second {
+		t.Fatalf("expected the reserved folder to be left out of the fingerprint, got %s then %s", second, third)
+	}
+}
+
+func emptyFolder(t *testing.T) string {
+	folder, err := ioutil.TempDir("", "ignore")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return folder
+}
+
+func writeFile(t *testing.T, root string, name string, content string) {
+	filePath := filepath.Join(root, name)
+
+	err := os.MkdirAll(filepath.Dir(filePath), 0755)
+	if err == nil {
+		err = ioutil.WriteFile(filePath, []byte(content), 0644)
+	}
+
+	if err != nil {
+		t.Fatal(err)
+	}
+}
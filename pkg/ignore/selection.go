@@ -0,0 +1,77 @@
+package ignore
+
+import (
+	"path"
+	"sort"
+	"strings"
+)
+
+// Selection represents the Dropbox subfolders chosen for synchronization. Paths
+// are relative to the synchronized folder and compared without case, like
+// Dropbox does. An empty include list selects everything not excluded
+type Selection struct {
+	Include []string
+	Exclude []string
+}
+
+// NewSelection creates a selection from included and excluded subfolders
+func NewSelection(include []string, exclude []string) Selection {
+	return Selection{Include: cleanPaths(include), Exclude: cleanPaths(exclude)}
+}
+
+// Selected reports whether a path is synchronized. Parent folders of the
+// included subfolders are selected as well, so the subfolders have a place
+// to live in, but not their other content
+func (s Selection) Selected(relativePath string) bool {
+	relativePath = cleanPath(relativePath)
+
+	for _, excluded := range s.Exclude {
+		if isWithin(relativePath, excluded) {
+			return false
+		}
+	}
+
+	if len(s.Include) == 0 {
+		return true
+	}
+
+	for _, included := range s.Include {
+		if isWithin(relativePath, included) || isWithin(included, relativePath) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// String returns a canonical representation of the selection, empty when
+// everything is selected
+func (s Selection) String() string {
+	if len(s.Include) == 0 && len(s.Exclude) == 0 {
+		return ""
+	}
+
+	return "include=" + strings.Join(s.Include, ",") + ";exclude=" + strings.Join(s.Exclude, ",")
+}
+
+func cleanPaths(paths []string) []string {
+	cleaned := make([]string, 0, len(paths))
+	for _, p := range paths {
+		if p := cleanPath(p); p != "" {
+			cleaned = append(cleaned, p)
+		}
+	}
+
+	sort.Strings(cleaned)
+
+	return cleaned
+}
+
+func cleanPath(p string) string {
+	return strings.ToLower(strings.TrimRight(path.Clean("/"+p), "/"))
+}
+
+// isWithin reports whether a path is a folder or below it
+func isWithin(relativePath string, folder string) bool {
+	return relativePath == folder || strings.HasPrefix(relativePath, folder+"/")
+}
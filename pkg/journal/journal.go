@@ -0,0 +1,189 @@
+package journal
+
+import (
+	"bufio"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// compactThreshold is the number of records appended since the last snapshot
+// below which a journal is never compacted while running
+const compactThreshold = 10000
+
+// Journal represents a file of JSON records, one per line. Every change is
+// appended to it and the whole file is replaced by a snapshot of the current
+// records when compacted, which happens when opened and once the records
+// appended outnumber the ones of the last snapshot. A journal isn't safe for
+// concurrent use, its owner serializes the calls, including the snapshots
+type Journal struct {
+	appended    int
+	file        *os.File
+	name        string
+	path        string
+	snapshot    Snapshot
+	snapshotted int
+}
+
+// Snapshot writes the current records with `write`
+type Snapshot func(write func(record interface{}) error) error
+
+// Open replays the records saved at the given path, creating the file when
+// missing, and compacts it. `name` describes the journal in errors
+func Open(filePath string, name string, replay func(line []byte) error, snapshot Snapshot) (*Journal, error) {
+	j := &Journal{name: name, path: filePath, snapshot: snapshot}
+
+	err := os.MkdirAll(path.Dir(filePath), 0700)
+	if err != nil {
+		return nil, errors.Wrapf(err, "can't create %s folder", name)
+	}
+
+	err = j.load(replay)
+	if err != nil {
+		return nil, err
+	}
+
+	err = j.Compact()
+	if err != nil {
+		if j.file != nil {
+			j.file.Close()
+		}
+
+		return nil, err
+	}
+
+	return j, nil
+}
+
+// Append writes a record at the end of the journal. The journal is compacted when
+// most of its records are superseded by later ones
+func (j *Journal) Append(record interface{}) error {
+	if j.file == nil {
+		return errors.Errorf("%s is closed", j.name)
+	}
+
+	line, err := json.Marshal(record)
+	if err != nil {
+		return errors.Wrapf(err, "can't encode %s record", j.name)
+	}
+
+	_, err = j.file.Write(append(line, '\n'))
+	if err != nil {
+		return errors.Wrapf(err, "can't write %s record", j.name)
+	}
+
+	j.appended++
+	if j.appended > compactThreshold && j.appended > j.snapshotted {
+		err = j.Compact()
+		if err != nil {
+			// the record is saved, the journal is compacted again later
+			logrus.Warnf("can't compact %s: %s", j.name, err)
+			j.appended = 0
+		}
+	}
+
+	return nil
+}
+
+// Compact replaces the journal with a snapshot of the current records. The
+// journal is kept as is when the snapshot can't be written
+func (j *Journal) Compact() error {
+	if j.file != nil {
+		err := j.file.Close()
+		j.file = nil
+		if err != nil {
+			return errors.Wrapf(err, "can't close %s file", j.name)
+		}
+	}
+
+	snapshotErr := j.writeSnapshot()
+
+	file, err := os.OpenFile(j.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return errors.Wrapf(err, "can't open %s file", j.name)
+	}
+
+	j.file = file
+
+	return snapshotErr
+}
+
+// Close compacts the journal and releases the underlying file
+func (j *Journal) Close() error {
+	if j.file == nil {
+		return nil
+	}
+
+	err := j.file.Close()
+	j.file = nil
+	if err != nil {
+		return errors.Wrapf(err, "can't close %s file", j.name)
+	}
+
+	return j.writeSnapshot()
+}
+
+func (j *Journal) load(replay func(line []byte) error) error {
+	file, err := os.Open(j.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+
+	if err != nil {
+		return errors.Wrapf(err, "can't open %s file", j.name)
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		err = replay(scanner.Bytes())
+		if err != nil {
+			// a partially written last line is expected after a crash
+			break
+		}
+	}
+
+	return errors.Wrapf(scanner.Err(), "can't read %s file", j.name)
+}
+
+func (j *Journal) writeSnapshot() error {
+	temporary, err := ioutil.TempFile(path.Dir(j.path), path.Base(j.path)+".")
+	if err != nil {
+		return errors.Wrapf(err, "can't create %s snapshot", j.name)
+	}
+	defer os.Remove(temporary.Name())
+
+	writer := bufio.NewWriter(temporary)
+	encoder := json.NewEncoder(writer)
+	written := 0
+	err = j.snapshot(func(record interface{}) error {
+		written++
+
+		return encoder.Encode(record)
+	})
+	if err == nil {
+		err = writer.Flush()
+	}
+	if err == nil {
+		err = temporary.Sync()
+	}
+	temporary.Close()
+	if err != nil {
+		return errors.Wrapf(err, "can't write %s snapshot", j.name)
+	}
+
+	err = os.Rename(temporary.Name(), j.path)
+	if err != nil {
+		return errors.Wrapf(err, "can't replace %s file", j.name)
+	}
+
+	j.appended = 0
+	j.snapshotted = written
+
+	return nil
+}
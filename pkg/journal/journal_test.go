@@ -0,0 +1,92 @@
+package journal_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/kdisneur/dropbox_sync/pkg/journal"
+)
+
+type counter struct {
+	values map[string]int
+}
+
+type counterRecord struct {
+	Key   string `json:"key"`
+	Value int    `json:"value"`
+}
+
+func (c *counter) replay(line []byte) error {
+	var r counterRecord
+	err := json.Unmarshal(line, &r)
+	if err != nil {
+		return err
+	}
+
+	c.values[r.Key] = r.Value
+
+	return nil
+}
+
+func (c *counter) snapshot(write func(record interface{}) error) error {
+	for key, value := range c.values {
+		err := write(counterRecord{Key: key, Value: value})
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func TestCompactWhileRunning(t *testing.T) {
+	folder, err := ioutil.TempDir("", "journal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(folder)
+
+	filePath := filepath.Join(folder, "counter.db")
+	c := &counter{values: make(map[string]int)}
+
+	j, err := journal.Open(filePath, "counter", c.replay, c.snapshot)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 1; i <= 25000; i++ {
+		key := []string{"a", "b"}[i%2]
+		c.values[key] = i
+
+		err = j.Append(counterRecord{Key: key, Value: i})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	content, err := ioutil.ReadFile(filePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if lines := bytes.Count(content, []byte("\n")); lines > 10002 {
+		t.Fatalf("expected the journal to be compacted, got %d records", lines)
+	}
+
+	// the file isn't closed, as after a crash
+	reopened := &counter{values: make(map[string]int)}
+	j2, err := journal.Open(filePath, "counter", reopened.replay, reopened.snapshot)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer j2.Close()
+	defer j.Close()
+
+	if reopened.values["a"] != 25000 || reopened.values["b"] != 24999 {
+		t.Fatalf("expected the last values to be replayed, got %v", reopened.values)
+	}
+}
@@ -9,11 +9,17 @@ const (
 	ActionTypeCreate internal.ActionType = "create"
 	// ActionTypeDelete represents a file deletion
 	ActionTypeDelete internal.ActionType = "delete"
+	// ActionTypeMove represents a file moved from `Source` to `File`
+	ActionTypeMove internal.ActionType = "move"
+	// ActionTypeOverflow represents changes lost because too many happened at
+	// once. The whole folder has to be compared again
+	ActionTypeOverflow internal.ActionType = "overflow"
 )
 
 // Action represents an action and the associate file happening on the
 // local filesystem
 type Action struct {
-	Type internal.ActionType
-	File File
+	Type   internal.ActionType
+	File   File
+	Source File
 }
@@ -3,6 +3,7 @@ package local
 import (
 	"github.com/kdisneur/dropbox_sync/pkg/local/internal"
 	"os"
+	"time"
 )
 
 const (
@@ -14,30 +15,47 @@ const (
 
 // File represents a file or folder on local system
 type File struct {
+	Inode        uint64
+	ModTime      time.Time
 	Path         string
 	RelativePath string
+	Size         int64
 	Type         internal.FileType
 }
 
 func fileFromEvent(eventName string) File {
-	fileType := fileTypeFromPath(eventName)
-
-	return File{
-		Type:         fileType,
+	file := File{
+		Type:         FileTypeFile,
 		Path:         eventName,
 		RelativePath: eventName,
 	}
-}
 
-func fileTypeFromPath(path string) internal.FileType {
-	info, err := os.Stat(path)
-	if err != nil {
-		return FileTypeFile
+	info, err := os.Stat(eventName)
+	if err == nil {
+		file = fileFromInfo(eventName, info)
 	}
 
+	return file
+}
+
+func fileFromInfo(path string, info os.FileInfo) File {
+	fileType := FileTypeFile
 	if info.IsDir() {
-		return FileTypeFolder
+		fileType = FileTypeFolder
 	}
 
-	return FileTypeFile
+	return File{
+		Inode:        inode(info),
+		ModTime:      info.ModTime(),
+		Path:         path,
+		RelativePath: path,
+		Size:         info.Size(),
+		Type:         fileType,
+	}
+}
+
+// sameContent reports whether two stats of a file have the same size and
+// modification time, so its content can't have changed in between
+func (f File) sameContent(other File) bool {
+	return f.Size == other.Size && f.ModTime.Equal(other.ModTime)
 }
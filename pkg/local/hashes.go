@@ -0,0 +1,213 @@
+package local
+
+import (
+	"encoding/json"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/kdisneur/dropbox_sync/pkg/journal"
+)
+
+// HashCache remembers the Dropbox content hash of local files, so files which
+// didn't change since they were last hashed are never read again. A file is
+// considered unchanged while its inode, size and modification time are the same.
+// Every change is appended to a journal file which is compacted when the cache is
+// opened and once most of its records are outdated. A nil cache remembers nothing
+type HashCache struct {
+	entries map[string]hashEntry
+	journal *journal.Journal
+	mutex   sync.Mutex
+}
+
+// hashEntry represents the hash of a file along with the stats it had when hashed
+type hashEntry struct {
+	Hash      string `json:"hash"`
+	Inode     uint64 `json:"inode"`
+	ModTimeNs int64  `json:"mtime_ns"`
+	Size      int64  `json:"size"`
+}
+
+type hashRecord struct {
+	Op    string     `json:"op"`
+	Path  string     `json:"path"`
+	Entry *hashEntry `json:"entry,omitempty"`
+	To    string     `json:"to,omitempty"`
+}
+
+const (
+	hashOpPut    = "put"
+	hashOpDelete = "delete"
+	hashOpMove   = "move"
+)
+
+// OpenHashCache loads the cache saved at the given path, creating it when missing
+func OpenHashCache(filePath string) (*HashCache, error) {
+	c := &HashCache{entries: make(map[string]hashEntry)}
+
+	j, err := journal.Open(filePath, "hash cache", c.replay, c.snapshot)
+	if err != nil {
+		return nil, err
+	}
+	c.journal = j
+
+	return c, nil
+}
+
+// Hash returns the hash of a file when it didn't change since it was recorded
+func (c *HashCache) Hash(filePath string, info os.FileInfo) (string, bool) {
+	if c == nil {
+		return "", false
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	entry, ok := c.entries[filePath]
+	if !ok || entry != newHashEntry(entry.Hash, info) {
+		return "", false
+	}
+
+	return entry.Hash, true
+}
+
+// Put records the hash of a file with its current stats
+func (c *HashCache) Put(filePath string, info os.FileInfo, hash string) error {
+	if c == nil || info.IsDir() {
+		return nil
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	entry := newHashEntry(hash, info)
+	if previous, ok := c.entries[filePath]; ok && previous == entry {
+		return nil
+	}
+	c.entries[filePath] = entry
+
+	return c.journal.Append(hashRecord{Op: hashOpPut, Path: filePath, Entry: &entry})
+}
+
+// Forget drops the hashes of a path and everything below it
+func (c *HashCache) Forget(filePath string) error {
+	if c == nil {
+		return nil
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if !c.deleteTree(filePath) {
+		return nil
+	}
+
+	return c.journal.Append(hashRecord{Op: hashOpDelete, Path: filePath})
+}
+
+// Move records the hashes of a path and everything below it under a new path.
+// A rename keeps the inode, size and modification time so they stay valid
+func (c *HashCache) Move(from string, to string) error {
+	if c == nil {
+		return nil
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if !c.moveTree(from, to) {
+		return nil
+	}
+
+	return c.journal.Append(hashRecord{Op: hashOpMove, Path: from, To: to})
+}
+
+// Close compacts the journal and releases the underlying file
+func (c *HashCache) Close() error {
+	if c == nil {
+		return nil
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	return c.journal.Close()
+}
+
+func newHashEntry(hash string, info os.FileInfo) hashEntry {
+	return hashEntry{
+		Hash:      hash,
+		Inode:     inode(info),
+		ModTimeNs: info.ModTime().UnixNano(),
+		Size:      info.Size(),
+	}
+}
+
+func (c *HashCache) replay(line []byte) error {
+	var r hashRecord
+	err := json.Unmarshal(line, &r)
+	if err != nil {
+		return err
+	}
+
+	switch r.Op {
+	case hashOpPut:
+		if r.Entry != nil {
+			c.entries[r.Path] = *r.Entry
+		}
+	case hashOpDelete:
+		c.deleteTree(r.Path)
+	case hashOpMove:
+		c.moveTree(r.Path, r.To)
+	}
+
+	return nil
+}
+
+func (c *HashCache) snapshot(write func(record interface{}) error) error {
+	for filePath, entry := range c.entries {
+		entry := entry
+		err := write(hashRecord{Op: hashOpPut, Path: filePath, Entry: &entry})
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// deleteTree drops the entries of a path and below, and reports whether there were some
+func (c *HashCache) deleteTree(filePath string) bool {
+	deleted := false
+
+	prefix := filePath + "/"
+	for candidate := range c.entries {
+		if candidate == filePath || strings.HasPrefix(candidate, prefix) {
+			delete(c.entries, candidate)
+			deleted = true
+		}
+	}
+
+	return deleted
+}
+
+// moveTree moves the entries of a path and below, and reports whether there were some
+func (c *HashCache) moveTree(from string, to string) bool {
+	moved := make(map[string]hashEntry)
+
+	prefix := from + "/"
+	for candidate, entry := range c.entries {
+		if candidate != from && !strings.HasPrefix(candidate, prefix) {
+			continue
+		}
+
+		moved[to+strings.TrimPrefix(candidate, from)] = entry
+		delete(c.entries, candidate)
+	}
+
+	for candidate, entry := range moved {
+		c.entries[candidate] = entry
+	}
+
+	return len(moved) > 0
+}
@@ -0,0 +1,19 @@
+//go:build !windows
+// +build !windows
+
+package local
+
+import (
+	"os"
+	"syscall"
+)
+
+// inode returns the inode number of a file, used to follow it across renames
+func inode(info os.FileInfo) uint64 {
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return 0
+	}
+
+	return uint64(stat.Ino)
+}
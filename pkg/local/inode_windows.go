@@ -0,0 +1,13 @@
+//go:build windows
+// +build windows
+
+package local
+
+import (
+	"os"
+)
+
+// inode is not available on Windows: renames are seen as a deletion and a creation
+func inode(info os.FileInfo) uint64 {
+	return 0
+}
@@ -0,0 +1,85 @@
+package local
+
+import (
+	"time"
+)
+
+// moveWindow is how long a renamed file waits for its new name before being
+// considered as deleted
+const moveWindow = time.Second
+
+// pendingMove represents a renamed file waiting for its new name
+type pendingMove struct {
+	file  File
+	timer *time.Timer
+}
+
+// startMove keeps a renamed file until the creation of its new name is received.
+// Files moved outside of the watched folder are reported as deleted
+func (s *Scanner) startMove(file File) {
+	s.mutex.Lock()
+
+	for _, pending := range s.pendingMoves {
+		if pending.file.Path == file.Path {
+			// a watched folder reports its own rename in addition to its parent
+			s.mutex.Unlock()
+			return
+		}
+	}
+
+	known, ok := s.known[file.Path]
+	if !ok || known.Inode == 0 {
+		s.forgetTree(file.Path)
+		s.mutex.Unlock()
+
+		s.emit(Action{Type: ActionTypeDelete, File: file})
+		return
+	}
+
+	file.Inode = known.Inode
+	file.Type = known.Type
+
+	pending := &pendingMove{file: file}
+	pending.timer = time.AfterFunc(moveWindow, func() { s.expireMove(file.Inode) })
+	s.pendingMoves[file.Inode] = pending
+
+	s.mutex.Unlock()
+}
+
+// finishMove returns the renamed file the created one comes from, if any
+func (s *Scanner) finishMove(file File) (File, bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	pending, ok := s.pendingMoves[file.Inode]
+	if file.Inode == 0 || !ok {
+		return File{}, false
+	}
+
+	pending.timer.Stop()
+	delete(s.pendingMoves, file.Inode)
+	s.moveSettling(pending.file.Path, file.Path)
+
+	err := s.hashes.Move(pending.file.Path, file.Path)
+	if err != nil {
+		s.logger.Warnf("can't update hash cache: %s", err)
+	}
+	s.forgetTree(pending.file.Path)
+	s.known[file.Path] = file
+
+	return pending.file, true
+}
+
+func (s *Scanner) expireMove(inode uint64) {
+	s.mutex.Lock()
+	pending, ok := s.pendingMoves[inode]
+	if ok {
+		delete(s.pendingMoves, inode)
+		s.forgetTree(pending.file.Path)
+	}
+	s.mutex.Unlock()
+
+	if ok {
+		s.emit(Action{Type: ActionTypeDelete, File: pending.file})
+	}
+}
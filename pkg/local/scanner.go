@@ -1,32 +1,55 @@
 package local
 
 import (
+	"context"
 	"github.com/fsnotify/fsnotify"
+	"github.com/kdisneur/dropbox_sync/pkg/ignore"
 	"github.com/pkg/errors"
 	"github.com/sirupsen/logrus"
 	"os"
 	"path"
 	"strings"
+	"sync"
 )
 
+// maxPendingActions is the number of actions kept while nothing reads them, for
+// instance during a reconcile. Beyond it, actions are dropped and an overflow is
+// reported instead
+const maxPendingActions = 10000
+
 // Scanner represents a list of actions
 type Scanner struct {
-	actionEvents  chan Action
+	closeOnce     sync.Once
 	currentAction *Action
+	done          chan struct{}
 	err           error
 	errEvents     chan error
+	hashes        *HashCache
+	known         map[string]File
 	logger        *logrus.Entry
+	matcher       *ignore.Matcher
+	mutex         sync.Mutex
+	overflowed    bool
 	path          string
+	pending       []Action
+	pendingMoves  map[uint64]*pendingMove
+	ready         chan struct{}
+	settling      map[string]*settlingFile
 	watcher       *fsnotify.Watcher
 }
 
-// NewScanner creates a new folder scanner
-func NewScanner(logger *logrus.Entry, path string) *Scanner {
+// NewScanner creates a new folder scanner. Ignored paths are never reported
+func NewScanner(logger *logrus.Entry, path string, matcher *ignore.Matcher) *Scanner {
 	scanner := &Scanner{
 		logger:       logger,
+		matcher:      matcher,
 		errEvents:    make(chan error),
-		actionEvents: make(chan Action),
+		done:         make(chan struct{}),
+		known:        make(map[string]File),
 		path:         path,
+		pendingMoves: make(map[uint64]*pendingMove),
+		ready:        make(chan struct{}, 1),
+		settling:     make(map[string]*settlingFile),
 	}
 
 	watcher, err := fsnotify.NewWatcher()
@@ -38,7 +61,7 @@ func NewScanner(logger *logrus.Entry, path string) *Scanner {
 
 	go scanner.listenEvents()
 
-	err = watcher.Add(path)
+	err = scanner.watchTree(path)
 	if err != nil {
 		scanner.err = err
 	}
@@ -47,19 +70,56 @@ func NewScanner(logger *logrus.Entry, path string) *Scanner {
 }
 
 // Next replace the `Action` with the following one if it can and return false if it can't
-func (s *Scanner) Next() bool {
+func (s *Scanner) Next(ctx context.Context) bool {
 	if s.err != nil {
 		return false
 	}
 
-	select {
-	case action := <-s.actionEvents:
-		s.currentAction = &action
-		return true
-	case err := <-s.errEvents:
-		s.err = err
+	if ctx.Err() != nil {
+		s.err = ctx.Err()
 		return false
 	}
+
+	for {
+		action, ok := s.pop()
+		if ok {
+			s.currentAction = &action
+			return true
+		}
+
+		select {
+		case <-s.ready:
+		case err := <-s.errEvents:
+			s.err = err
+			return false
+		case <-ctx.Done():
+			s.err = ctx.Err()
+			return false
+		}
+	}
+}
+
+// Close stops watching the folder
+func (s *Scanner) Close() error {
+	var err error
+
+	s.closeOnce.Do(func() {
+		close(s.done)
+
+		if s.watcher != nil {
+			err = s.watcher.Close()
+		}
+	})
+
+	return err
+}
+
+// UseHashCache makes the cached hashes follow the removals and renames of the files
+func (s *Scanner) UseHashCache(hashes *HashCache) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.hashes = hashes
 }
 
 // NotifyCreation creates a new watcher on the folder
@@ -71,14 +131,18 @@ func (s *Scanner) NotifyCreation(relativePath string) {
 	}
 
 	if info.IsDir() {
-		s.watcher.Add(absolutePath)
+		s.watchTree(absolutePath)
 	}
 }
 
 // NotifyDeletion removes the watcher of the folder
 func (s *Scanner) NotifyDeletion(relativePath string) {
 	absolutePath := path.Join(s.path, relativePath)
-	s.watcher.Remove(absolutePath)
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.forgetTree(absolutePath)
 }
 
 // Entry returns the current scanner content
@@ -100,26 +164,272 @@ func (s *Scanner) listenEvents() {
 		select {
 		case event, ok := <-s.watcher.Events:
 			if !ok {
-				s.errEvents <- errors.New("invalid event received")
+				s.emitError(errors.New("invalid event received"))
+				return
 			}
 
-			file := fileFromEvent(event.Name)
-			file.RelativePath = relativePath(s.path, file.Path)
+			s.handleEvent(event)
+		case err, ok := <-s.watcher.Errors:
+			if !ok {
+				s.emitError(errors.New("invalid error event received"))
+				return
+			}
 
-			action := Action{Type: ActionTypeCreate, File: file}
-			if event.Op&fsnotify.Remove == fsnotify.Remove {
-				action.Type = ActionTypeDelete
+			if err == fsnotify.ErrEventOverflow {
+				s.logger.Warnf("too many local changes at once. some of them are lost")
+				s.overflow()
+				continue
 			}
 
-			s.actionEvents <- action
-		case err, ok := <-s.watcher.Errors:
-			if ok {
-				s.errEvents <- err
-			} else {
-				s.errEvents <- errors.New("invalid error event received")
+			s.emitError(err)
+		case <-s.done:
+			return
+		}
+	}
+}
+
+// emit queues an action, so watching never waits for the actions to be read.
+// Once too many are waiting, the following ones are dropped and an overflow is
+// reported instead
+func (s *Scanner) emit(action Action) {
+	s.mutex.Lock()
+	if len(s.pending) < maxPendingActions {
+		s.pending = append(s.pending, action)
+	} else {
+		s.overflowed = true
+	}
+	s.mutex.Unlock()
+
+	s.notify()
+}
+
+// overflow reports that changes have been lost
+func (s *Scanner) overflow() {
+	s.mutex.Lock()
+	s.overflowed = true
+	s.mutex.Unlock()
+
+	s.notify()
+}
+
+// notify wakes up `Next` when it waits for an action
+func (s *Scanner) notify() {
+	select {
+	case s.ready <- struct{}{}:
+	default:
+	}
+}
+
+// pop returns the oldest action queued, then the overflow once every action
+// kept has been read
+func (s *Scanner) pop() (Action, bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if len(s.pending) > 0 {
+		action := s.pending[0]
+		s.pending = s.pending[1:]
+		if len(s.pending) == 0 {
+			s.pending = nil
+		}
+
+		return action, true
+	}
+
+	if s.overflowed {
+		s.overflowed = false
+		return Action{Type: ActionTypeOverflow}, true
+	}
+
+	return Action{}, false
+}
+
+// emitError reports an error unless the scanner has been closed
+func (s *Scanner) emitError(err error) {
+	select {
+	case s.errEvents <- err:
+	case <-s.done:
+	}
+}
+
+func (s *Scanner) handleEvent(event fsnotify.Event) {
+	if !strings.HasPrefix(event.Name, s.path+"/") {
+		// events of a watcher removed in the meantime don't carry a usable path
+		return
+	}
+
+	if IsTemporary(event.Name) {
+		return
+	}
+
+	file := fileFromEvent(event.Name)
+	file.RelativePath = relativePath(s.path, file.Path)
+
+	if ignore.IsIgnoreFile(file.Path) {
+		s.matcher.Reload(path.Dir(file.RelativePath))
+	}
+
+	if s.isIgnored(file) {
+		return
+	}
+
+	switch {
+	case event.Op&fsnotify.Remove == fsnotify.Remove:
+		s.mutex.Lock()
+		if known, ok := s.known[file.Path]; ok {
+			file.Type = known.Type
+		}
+		s.forgetTree(file.Path)
+		s.mutex.Unlock()
+
+		s.emit(Action{Type: ActionTypeDelete, File: file})
+	case event.Op&fsnotify.Rename == fsnotify.Rename && !fileExists(file.Path):
+		s.startMove(file)
+	case event.Op&fsnotify.Create == fsnotify.Create:
+		source, moved := s.finishMove(file)
+		if moved {
+			s.emit(Action{Type: ActionTypeMove, File: file, Source: source})
+
+			if file.Type == FileTypeFolder {
+				s.watchTree(file.Path)
 			}
+
+			return
 		}
+
+		s.remember(file)
+		s.emitChange(file)
+
+		if file.Type == FileTypeFolder {
+			s.watchNewFolder(file.Path)
+		}
+	case event.Op&fsnotify.Write == fsnotify.Write:
+		if s.isUnchanged(file) {
+			return
+		}
+
+		s.emitChange(file)
+	default:
+		// attribute changes, like permissions, never change the content
+	}
+}
+
+// isUnchanged reports whether a written file still has the size and modification
+// time it had when it was last reported
+func (s *Scanner) isUnchanged(file File) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	known, ok := s.known[file.Path]
+
+	return ok && file.Type == FileTypeFile && known.Type == FileTypeFile && known.sameContent(file)
+}
+
+// emitChange reports a created or updated folder right away, and a file once it
+// settled
+func (s *Scanner) emitChange(file File) {
+	if file.Type == FileTypeFolder {
+		s.emit(Action{Type: ActionTypeCreate, File: file})
+		return
 	}
+
+	s.settle(file)
+}
+
+// watchTree adds a watcher on the folder and all its subfolders
+func (s *Scanner) watchTree(root string) error {
+	err := s.watcher.Add(root)
+	if err != nil {
+		return errors.Wrapf(err, "can't watch folder '%s'", root)
+	}
+
+	files, err := WalkFrom(s.path, root, s.matcher)
+	if err != nil {
+		return err
+	}
+
+	for _, file := range files {
+		s.remember(file)
+
+		if file.Type != FileTypeFolder {
+			continue
+		}
+
+		err = s.watcher.Add(file.Path)
+		if err != nil && !os.IsNotExist(err) {
+			return errors.Wrapf(err, "can't watch folder '%s'", file.Path)
+		}
+	}
+
+	return nil
+}
+
+// remember keeps the inode of a file so it can be followed when renamed
+func (s *Scanner) remember(file File) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.known[file.Path] = file
+}
+
+// forgetTree drops what is known about a path and everything below it, including
+// the watchers of its folders and the cached hashes. The mutex must be held
+func (s *Scanner) forgetTree(absolutePath string) {
+	err := s.hashes.Forget(absolutePath)
+	if err != nil {
+		s.logger.Warnf("can't update hash cache: %s", err)
+	}
+
+	prefix := absolutePath + "/"
+	for candidate, file := range s.known {
+		if candidate != absolutePath && !strings.HasPrefix(candidate, prefix) {
+			continue
+		}
+
+		if file.Type == FileTypeFolder {
+			s.watcher.Remove(candidate)
+		}
+
+		delete(s.known, candidate)
+	}
+
+	s.watcher.Remove(absolutePath)
+}
+
+// watchNewFolder watches a folder created locally and reports the files which
+// landed in it before the watcher existed
+func (s *Scanner) watchNewFolder(folderPath string) {
+	err := s.watchTree(folderPath)
+	if err != nil {
+		s.logger.Warnf("can't watch new folder: %s", err)
+		return
+	}
+
+	files, err := WalkFrom(s.path, folderPath, s.matcher)
+	if err != nil {
+		s.logger.Warnf("can't scan new folder: %s", err)
+		return
+	}
+
+	for _, file := range files {
+		s.emitChange(file)
+	}
+}
+
+// isIgnored reports whether a file matches the ignore rules. A file which doesn't
+// exist anymore is ignored when it would be either as a file or as a folder
+func (s *Scanner) isIgnored(file File) bool {
+	if !fileExists(file.Path) {
+		return s.matcher.MatchAny(file.RelativePath)
+	}
+
+	return s.matcher.Match(file.RelativePath, file.Type == FileTypeFolder)
+}
+
+func fileExists(path string) bool {
+	_, err := os.Lstat(path)
+
+	return err == nil
 }
 
 func relativePath(base string, path string) string {
@@ -0,0 +1,99 @@
+package local
+
+import (
+	"os"
+	"strings"
+	"time"
+)
+
+// settleWindow is how long a changed file has to stay untouched, with the same
+// size and modification time, before its change is reported
+const settleWindow = time.Second
+
+// settlingFile represents a changed file waiting to be stable
+type settlingFile struct {
+	file    File
+	modTime time.Time
+	size    int64
+	touched time.Time
+}
+
+// settle reports the change of a file once it stopped changing, so the burst of
+// events of a single save becomes one action and half-written files are never
+// reported. Following events on the file restart the window
+func (s *Scanner) settle(file File) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if settling, ok := s.settling[file.Path]; ok {
+		settling.touched = time.Now()
+		return
+	}
+
+	settling := &settlingFile{file: file, touched: time.Now()}
+	if info, err := os.Lstat(file.Path); err == nil {
+		settling.modTime = info.ModTime()
+		settling.size = info.Size()
+	}
+
+	s.settling[file.Path] = settling
+	time.AfterFunc(settleWindow, func() { s.expireSettle(settling) })
+}
+
+// expireSettle reports the change of a file when it has been stable for the
+// whole window, or waits again
+func (s *Scanner) expireSettle(settling *settlingFile) {
+	s.mutex.Lock()
+
+	if s.settling[settling.file.Path] != settling {
+		s.mutex.Unlock()
+		return
+	}
+
+	if quiet := time.Since(settling.touched); quiet < settleWindow {
+		time.AfterFunc(settleWindow-quiet, func() { s.expireSettle(settling) })
+		s.mutex.Unlock()
+		return
+	}
+
+	info, err := os.Lstat(settling.file.Path)
+	if err != nil {
+		// the file is gone, its removal or rename is reported by its own event
+		delete(s.settling, settling.file.Path)
+		s.mutex.Unlock()
+		return
+	}
+
+	if info.Size() != settling.size || !info.ModTime().Equal(settling.modTime) {
+		settling.modTime = info.ModTime()
+		settling.size = info.Size()
+		settling.touched = time.Now()
+		time.AfterFunc(settleWindow, func() { s.expireSettle(settling) })
+		s.mutex.Unlock()
+		return
+	}
+
+	delete(s.settling, settling.file.Path)
+	settling.file.Inode = inode(info)
+	settling.file.ModTime = info.ModTime()
+	settling.file.Size = info.Size()
+	s.known[settling.file.Path] = settling.file
+	s.mutex.Unlock()
+
+	s.emit(Action{Type: ActionTypeCreate, File: settling.file})
+}
+
+// moveSettling makes the files settling below a renamed path wait under their new
+// path, so their change is reported after the move. The mutex must be held
+func (s *Scanner) moveSettling(sourcePath string, targetPath string) {
+	for candidate, settling := range s.settling {
+		if candidate != sourcePath && !strings.HasPrefix(candidate, sourcePath+"/") {
+			continue
+		}
+
+		delete(s.settling, candidate)
+		settling.file.Path = targetPath + strings.TrimPrefix(candidate, sourcePath)
+		settling.file.RelativePath = relativePath(s.path, settling.file.Path)
+		s.settling[settling.file.Path] = settling
+	}
+}
@@ -0,0 +1,24 @@
+package local
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+)
+
+// temporaryMarker is part of the name of every temporary file
+const temporaryMarker = ".dropbox_sync-"
+
+// TempFile creates a hidden temporary file next to the given path, so it can be
+// renamed over it atomically. Temporary files are never reported by the scanner
+func TempFile(filePath string) (*os.File, error) {
+	return ioutil.TempFile(path.Dir(filePath), "."+path.Base(filePath)+temporaryMarker)
+}
+
+// IsTemporary reports whether a file has been created by `TempFile`
+func IsTemporary(filePath string) bool {
+	name := path.Base(filePath)
+
+	return strings.HasPrefix(name, ".") && strings.Contains(name, temporaryMarker)
+}
@@ -0,0 +1,248 @@
+package local
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/kdisneur/dropbox_sync/pkg/ignore"
+	"github.com/pkg/errors"
+)
+
+// DefaultTrashRetention is how long files are kept in the trash by default
+const DefaultTrashRetention = 30 * 24 * time.Hour
+
+// trashTimeFormat names the trash batches after the time their files were removed
+const trashTimeFormat = "2006-01-02T15-04-05.000000"
+
+// Trash represents the local files removed or overwritten by the synchronizer.
+// They are kept in the synchronized folder itself, under
+// `.dropbox_sync/trash/<time>/<relative path>`, until they are purged
+type Trash struct {
+	basePath string
+	path     string
+}
+
+// TrashBatch represents the files removed at once
+type TrashBatch struct {
+	path string
+}
+
+// TrashedFile represents a file kept in the trash
+type TrashedFile struct {
+	Batch        string
+	DeletedAt    time.Time
+	Path         string
+	RelativePath string
+}
+
+// NewTrash creates the trash of a local folder
+func NewTrash(basePath string) *Trash {
+	return &Trash{
+		basePath: basePath,
+		path:     path.Join(basePath, ignore.ReservedFolder, "trash"),
+	}
+}
+
+// Batch starts a batch of files removed at once. Its folder is created with the
+// first file put in it
+func (t *Trash) Batch() *TrashBatch {
+	return &TrashBatch{path: path.Join(t.path, time.Now().UTC().Format(trashTimeFormat))}
+}
+
+// Put moves a file or a folder into the batch, keeping its path relative to the
+// synchronized folder
+func (b *TrashBatch) Put(filePath string, relativePath string) error {
+	trashedPath := path.Join(b.path, relativePath)
+
+	err := os.MkdirAll(path.Dir(trashedPath), 0700)
+	if err != nil {
+		return errors.Wrap(err, "can't create trash folder")
+	}
+
+	return errors.Wrapf(os.Rename(filePath, trashedPath), "can't move '%s' to the trash", filePath)
+}
+
+// Keep puts in the batch a copy of a file about to be overwritten. The copy is a
+// hard link when possible, so the file never disappears from its place
+func (b *TrashBatch) Keep(filePath string, relativePath string) error {
+	trashedPath := path.Join(b.path, relativePath)
+
+	err := os.MkdirAll(path.Dir(trashedPath), 0700)
+	if err != nil {
+		return errors.Wrap(err, "can't create trash folder")
+	}
+
+	if os.Link(filePath, trashedPath) == nil {
+		return nil
+	}
+
+	return errors.Wrapf(copyFile(filePath, trashedPath), "can't copy '%s' to the trash", filePath)
+}
+
+// List returns every file in the trash, the most recently removed first
+func (t *Trash) List() ([]TrashedFile, error) {
+	batches, err := t.batches()
+	if err != nil {
+		return nil, err
+	}
+
+	var files []TrashedFile
+	for i := len(batches) - 1; i >= 0; i-- {
+		batch := batches[i]
+		batchPath := path.Join(t.path, batch)
+		deletedAt, _ := time.Parse(trashTimeFormat, batch)
+
+		err = filepath.Walk(batchPath, func(filePath string, info os.FileInfo, err error) error {
+			if err != nil || info.IsDir() {
+				return err
+			}
+
+			files = append(files, TrashedFile{
+				Batch:        batch,
+				DeletedAt:    deletedAt,
+				Path:         filePath,
+				RelativePath: strings.TrimPrefix(filePath, batchPath),
+			})
+
+			return nil
+		})
+
+		if err != nil {
+			return nil, errors.Wrap(err, "can't list trash")
+		}
+	}
+
+	return files, nil
+}
+
+// Restore moves a file or a folder back to its place, from the given batch or
+// from the most recent one holding it when the batch is empty. It fails when
+// something already stands at its place
+func (t *Trash) Restore(relativePath string, batch string) error {
+	relativePath = path.Clean("/" + relativePath)
+
+	batches := []string{batch}
+	if batch == "" {
+		var err error
+		batches, err = t.batches()
+		if err != nil {
+			return err
+		}
+	}
+
+	for i := len(batches) - 1; i >= 0; i-- {
+		batchPath := path.Join(t.path, batches[i])
+		trashedPath := path.Join(batchPath, relativePath)
+		if _, err := os.Lstat(trashedPath); err != nil {
+			continue
+		}
+
+		filePath := path.Join(t.basePath, relativePath)
+		if _, err := os.Lstat(filePath); err == nil {
+			return errors.Errorf("can't restore '%s': it already exists", filePath)
+		}
+
+		err := os.MkdirAll(path.Dir(filePath), 0750)
+		if err != nil {
+			return errors.Wrap(err, "can't create restored file folder")
+		}
+
+		err = os.Rename(trashedPath, filePath)
+		if err != nil {
+			return errors.Wrapf(err, "can't restore '%s'", filePath)
+		}
+
+		removeEmptyParents(path.Dir(trashedPath), path.Dir(batchPath))
+
+		return nil
+	}
+
+	return errors.Errorf("'%s' isn't in the trash", relativePath)
+}
+
+// Purge removes the batches removed before the given time, or all of them when
+// the time is zero, and returns how many have been removed
+func (t *Trash) Purge(before time.Time) (int, error) {
+	batches, err := t.batches()
+	if err != nil {
+		return 0, err
+	}
+
+	purged := 0
+	for _, batch := range batches {
+		deletedAt, err := time.Parse(trashTimeFormat, batch)
+		if !before.IsZero() && (err != nil || !deletedAt.Before(before)) {
+			continue
+		}
+
+		err = os.RemoveAll(path.Join(t.path, batch))
+		if err != nil {
+			return purged, errors.Wrap(err, "can't purge trash")
+		}
+		purged++
+	}
+
+	return purged, nil
+}
+
+func copyFile(source string, destination string) error {
+	reader, err := os.Open(source)
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+
+	writer, err := os.OpenFile(destination, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(writer, reader)
+	closeErr := writer.Close()
+	if err != nil {
+		return err
+	}
+
+	return closeErr
+}
+
+// batches returns the name of the trash batches, the oldest first
+func (t *Trash) batches() ([]string, error) {
+	entries, err := ioutil.ReadDir(t.path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+
+	if err != nil {
+		return nil, errors.Wrap(err, "can't read trash")
+	}
+
+	var batches []string
+	for _, entry := range entries {
+		if entry.IsDir() {
+			batches = append(batches, entry.Name())
+		}
+	}
+
+	sort.Strings(batches)
+
+	return batches, nil
+}
+
+// removeEmptyParents removes a folder and its parents, up to the given one
+// excluded, as long as they are empty
+func removeEmptyParents(folderPath string, stop string) {
+	for folderPath != stop && strings.HasPrefix(folderPath, stop) {
+		if os.Remove(folderPath) != nil {
+			return
+		}
+
+		folderPath = path.Dir(folderPath)
+	}
+}
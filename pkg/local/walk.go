@@ -0,0 +1,55 @@
+package local
+
+import (
+	"os"
+	"path/filepath"
+
+	"github.com/kdisneur/dropbox_sync/pkg/ignore"
+	"github.com/pkg/errors"
+)
+
+// Walk lists every file and folder present below the given path, except the ignored ones
+func Walk(basePath string, matcher *ignore.Matcher) ([]File, error) {
+	return WalkFrom(basePath, basePath, matcher)
+}
+
+// WalkFrom lists every file and folder present below root, relatively to basePath,
+// except the ignored ones. Ignored folders are not walked through
+func WalkFrom(basePath string, root string, matcher *ignore.Matcher) ([]File, error) {
+	var files []File
+
+	err := filepath.Walk(root, func(filePath string, info os.FileInfo, err error) error {
+		if os.IsNotExist(err) {
+			return nil
+		}
+
+		if err != nil {
+			return err
+		}
+
+		if filePath == root || IsTemporary(filePath) {
+			return nil
+		}
+
+		file := fileFromInfo(filePath, info)
+		file.RelativePath = relativePath(basePath, filePath)
+
+		if matcher.Match(file.RelativePath, info.IsDir()) {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+
+			return nil
+		}
+
+		files = append(files, file)
+
+		return nil
+	})
+
+	if err != nil {
+		return nil, errors.Wrapf(err, "can't walk local folder '%s'", root)
+	}
+
+	return files, nil
+}
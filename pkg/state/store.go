@@ -0,0 +1,284 @@
+package state
+
+import (
+	"encoding/json"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/kdisneur/dropbox_sync/pkg/journal"
+)
+
+// Entry represents a path as it was the last time both sides agreed on its content
+type Entry struct {
+	ID          string    `json:"id,omitempty"`
+	ContentHash string    `json:"content_hash,omitempty"`
+	Folder      bool      `json:"folder,omitempty"`
+	ModTime     time.Time `json:"mtime"`
+	Rev         string    `json:"rev,omitempty"`
+	Size        int64     `json:"size,omitempty"`
+}
+
+// Store represents the synchronization state of a folder. Every change is
+// appended to a journal file which is compacted when the store is opened and
+// once most of its records are outdated
+type Store struct {
+	cursor      string
+	entries     map[string]Entry
+	ignoreRules string
+	journal     *journal.Journal
+	mutex       sync.Mutex
+	selection   string
+}
+
+type record struct {
+	Op          string `json:"op"`
+	Path        string `json:"path"`
+	Cursor      string `json:"cursor,omitempty"`
+	Entry       *Entry `json:"entry,omitempty"`
+	IgnoreRules string `json:"ignore_rules,omitempty"`
+	Selection   string `json:"selection,omitempty"`
+	To          string `json:"to,omitempty"`
+}
+
+const (
+	opCursor      = "cursor"
+	opPut         = "put"
+	opDelete      = "delete"
+	opMove        = "move"
+	opIgnoreRules = "ignore_rules"
+	opSelection   = "selection"
+)
+
+// Open loads the store saved at the given path, creating it when missing
+func Open(filePath string) (*Store, error) {
+	s := &Store{entries: make(map[string]Entry)}
+
+	j, err := journal.Open(filePath, "state", s.replay, s.snapshot)
+	if err != nil {
+		return nil, err
+	}
+	s.journal = j
+
+	return s, nil
+}
+
+// Get returns the entry recorded for a path
+func (s *Store) Get(relativePath string) (Entry, bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	entry, ok := s.entries[relativePath]
+
+	return entry, ok
+}
+
+// Put records the entry of a path
+func (s *Store) Put(relativePath string, entry Entry) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.entries[relativePath] = entry
+
+	return s.journal.Append(record{Op: opPut, Path: relativePath, Entry: &entry})
+}
+
+// Delete forgets a path and everything below it
+func (s *Store) Delete(relativePath string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.deleteTree(relativePath)
+
+	return s.journal.Append(record{Op: opDelete, Path: relativePath})
+}
+
+// Move records a path and everything below it under a new path
+func (s *Store) Move(from string, to string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.moveTree(from, to)
+
+	return s.journal.Append(record{Op: opMove, Path: from, To: to})
+}
+
+// Cursor returns the position in the Dropbox changes reached by the last run
+func (s *Store) Cursor() string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return s.cursor
+}
+
+// SetCursor records the position in the Dropbox changes up to which every change
+// has been applied. An empty cursor means the folder has to be listed again
+func (s *Store) SetCursor(cursor string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.cursor = cursor
+
+	return s.journal.Append(record{Op: opCursor, Cursor: cursor})
+}
+
+// Selection returns the selective sync the recorded paths have been synchronized with
+func (s *Store) Selection() string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return s.selection
+}
+
+// SetSelection records the selective sync the recorded paths are synchronized with
+func (s *Store) SetSelection(selection string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.selection = selection
+
+	return s.journal.Append(record{Op: opSelection, Selection: selection})
+}
+
+// IgnoreRules returns the fingerprint of the ignore rules the recorded paths have
+// been synchronized with
+func (s *Store) IgnoreRules() string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return s.ignoreRules
+}
+
+// SetIgnoreRules records the fingerprint of the ignore rules the recorded paths
+// are synchronized with
+func (s *Store) SetIgnoreRules(ignoreRules string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.ignoreRules = ignoreRules
+
+	return s.journal.Append(record{Op: opIgnoreRules, IgnoreRules: ignoreRules})
+}
+
+// Paths returns all the recorded paths
+func (s *Store) Paths() []string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	paths := make([]string, 0, len(s.entries))
+	for relativePath := range s.entries {
+		paths = append(paths, relativePath)
+	}
+
+	return paths
+}
+
+// Len returns the number of recorded paths
+func (s *Store) Len() int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return len(s.entries)
+}
+
+// Close compacts the journal and releases the underlying file
+func (s *Store) Close() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return s.journal.Close()
+}
+
+func (s *Store) replay(line []byte) error {
+	var r record
+	err := json.Unmarshal(line, &r)
+	if err != nil {
+		return err
+	}
+
+	switch r.Op {
+	case opCursor:
+		s.cursor = r.Cursor
+	case opIgnoreRules:
+		s.ignoreRules = r.IgnoreRules
+	case opSelection:
+		s.selection = r.Selection
+	case opPut:
+		if r.Entry != nil {
+			s.entries[r.Path] = *r.Entry
+		}
+	case opDelete:
+		s.deleteTree(r.Path)
+	case opMove:
+		s.moveTree(r.Path, r.To)
+	}
+
+	return nil
+}
+
+func (s *Store) snapshot(write func(record interface{}) error) error {
+	if s.cursor != "" {
+		err := write(record{Op: opCursor, Cursor: s.cursor})
+		if err != nil {
+			return err
+		}
+	}
+
+	if s.ignoreRules != "" {
+		err := write(record{Op: opIgnoreRules, IgnoreRules: s.ignoreRules})
+		if err != nil {
+			return err
+		}
+	}
+
+	if s.selection != "" {
+		err := write(record{Op: opSelection, Selection: s.selection})
+		if err != nil {
+			return err
+		}
+	}
+
+	for relativePath, entry := range s.entries {
+		entry := entry
+		err := write(record{Op: opPut, Path: relativePath, Entry: &entry})
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (s *Store) deleteTree(relativePath string) {
+	delete(s.entries, relativePath)
+
+	prefix := strings.TrimSuffix(relativePath, "/") + "/"
+	for candidate := range s.entries {
+		if strings.HasPrefix(candidate, prefix) {
+			delete(s.entries, candidate)
+		}
+	}
+}
+
+func (s *Store) moveTree(from string, to string) {
+	moved := make(map[string]Entry)
+
+	prefix := strings.TrimSuffix(from, "/") + "/"
+	for candidate, entry := range s.entries {
+		if candidate == from {
+			moved[to] = entry
+		} else if strings.HasPrefix(candidate, prefix) {
+			moved[path.Join(to, strings.TrimPrefix(candidate, prefix))] = entry
+		} else {
+			continue
+		}
+
+		delete(s.entries, candidate)
+	}
+
+	s.deleteTree(to)
+	for candidate, entry := range moved {
+		s.entries[candidate] = entry
+	}
+}
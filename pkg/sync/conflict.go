@@ -0,0 +1,128 @@
+package sync
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/kdisneur/dropbox_sync/pkg/dropbox"
+	"github.com/kdisneur/dropbox_sync/pkg/state"
+)
+
+// Conflicts returns the number of conflicts detected since the synchronizer started
+func (s *Sync) Conflicts() int64 {
+	return atomic.LoadInt64(&s.conflicts)
+}
+
+// resolveConflict keeps both versions of a file changed on both sides: the local
+// version is uploaded as a conflicted copy and renamed to it, then the Dropbox
+// version is downloaded at the original path. Dropbox picks another name when
+// the copy already exists there. In backup mode the local version is only
+// uploaded as a conflicted copy, and in download mode it is only renamed
+func (s *Sync) resolveConflict(ctx context.Context, remote dropbox.File, relativePath string) error {
+	filePath := path.Join(s.LocalBasePath, relativePath)
+	copyRelativePath := s.conflictedCopyPath(relativePath)
+
+	var uploaded *dropbox.File
+	if s.Mode.uploads() {
+		var err error
+		uploaded, err = s.uploadFile(ctx, filePath, path.Join(s.RemoteBasePath, copyRelativePath), dropbox.WriteModeAddRenamed)
+		if err != nil {
+			return err
+		}
+
+		copyRelativePath = path.Join(path.Dir(copyRelativePath), uploaded.Name)
+		s.dropboxEchoes.expect(copyRelativePath, echo{rev: uploaded.Rev})
+	}
+
+	total := atomic.AddInt64(&s.conflicts, 1)
+	s.DropboxLogger.
+		WithField("conflicts", total).
+		Warnf("file changed on both sides. local version saved as '%s'", copyRelativePath)
+
+	if s.Mode == ModeBackup {
+		return s.recordBackupConflict(remote, *uploaded, relativePath, copyRelativePath)
+	}
+
+	copyPath := path.Join(s.LocalBasePath, copyRelativePath)
+	err := os.Rename(filePath, copyPath)
+	if err != nil {
+		return err
+	}
+	s.expectLocalWrite(copyRelativePath, copyPath)
+
+	if uploaded != nil {
+		err = s.recordDropboxFile(*uploaded, copyPath)
+		if err != nil {
+			return err
+		}
+	}
+
+	return s.downloadConflicted(ctx, remote, relativePath)
+}
+
+// recordBackupConflict records the conflicted copy uploaded in backup mode, so
+// its name is never reused, and the local version as synchronized with the
+// Dropbox one, so the conflict is raised again only once the file changes again
+func (s *Sync) recordBackupConflict(remote dropbox.File, uploaded dropbox.File, relativePath string, copyRelativePath string) error {
+	err := s.State.Put(copyRelativePath, state.Entry{
+		ID:          uploaded.ID,
+		ContentHash: uploaded.ContentHash,
+		Rev:         uploaded.Rev,
+		Size:        uploaded.Size,
+	})
+	if err != nil {
+		return err
+	}
+
+	remote.ContentHash = uploaded.ContentHash
+
+	return s.recordDropboxFile(remote, path.Join(s.LocalBasePath, relativePath))
+}
+
+// downloadConflicted downloads the Dropbox version of a conflicted file at its original path
+func (s *Sync) downloadConflicted(ctx context.Context, remote dropbox.File, relativePath string) error {
+	filePath := path.Join(s.LocalBasePath, relativePath)
+
+	err := s.fetchDropboxContent(ctx, remote.RemotePath, filePath)
+	if err != nil {
+		return err
+	}
+	s.expectLocalWrite(relativePath, filePath)
+
+	return s.recordDropboxFile(remote, filePath)
+}
+
+// conflictedCopyPath returns a free path following the Dropbox naming:
+// "file (hostname's conflicted copy YYYY-MM-DD).ext"
+func (s *Sync) conflictedCopyPath(relativePath string) string {
+	extension := path.Ext(relativePath)
+	if extension == path.Base(relativePath) {
+		extension = ""
+	}
+
+	name := strings.TrimSuffix(relativePath, extension)
+	label := fmt.Sprintf("%s's conflicted copy %s", s.hostname, time.Now().Format("2006-01-02"))
+
+	candidate := fmt.Sprintf("%s (%s)%s", name, label, extension)
+	for i := 1; s.pathExists(candidate); i++ {
+		candidate = fmt.Sprintf("%s (%s %d)%s", name, label, i, extension)
+	}
+
+	return candidate
+}
+
+func (s *Sync) pathExists(relativePath string) bool {
+	_, err := os.Stat(path.Join(s.LocalBasePath, relativePath))
+	if err == nil {
+		return true
+	}
+
+	_, known := s.State.Get(relativePath)
+
+	return known
+}
@@ -0,0 +1,212 @@
+package sync
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	gosync "sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// DirectionDropboxToLocal is the direction of the changes done on Dropbox
+	DirectionDropboxToLocal = "dropbox-to-local"
+	// DirectionLocalToDropbox is the direction of the changes done locally
+	DirectionLocalToDropbox = "local-to-dropbox"
+)
+
+// minimumPercentDeletions is the number of deletions below which the percentage
+// of the folder isn't checked, so small folders can be emptied
+const minimumPercentDeletions = 10
+
+// pauseCheckInterval is how often a paused direction checks whether it has been confirmed
+const pauseCheckInterval = time.Second
+
+// DeletionLimit represents how many files can be deleted in a time window before
+// the direction is paused. A zero count or percent disables its check
+type DeletionLimit struct {
+	Count   int
+	Percent int
+	Window  time.Duration
+}
+
+// DefaultDeletionLimit pauses a direction when more than 500 files, or more than
+// half of the folder, are deleted within 5 minutes
+var DefaultDeletionLimit = DeletionLimit{
+	Count:   500,
+	Percent: 50,
+	Window:  5 * time.Minute,
+}
+
+// Pause represents a direction paused until its deletions are confirmed
+type Pause struct {
+	Direction string
+	Path      string
+	Reason    string
+}
+
+// Pauses returns the paused directions recorded in a pause folder
+func Pauses(pauseFolder string) ([]Pause, error) {
+	var pauses []Pause
+
+	for _, direction := range []string{DirectionDropboxToLocal, DirectionLocalToDropbox} {
+		pausePath := path.Join(pauseFolder, direction)
+
+		content, err := ioutil.ReadFile(pausePath)
+		if os.IsNotExist(err) {
+			continue
+		}
+
+		if err != nil {
+			return nil, errors.Wrap(err, "can't read pause file")
+		}
+
+		pauses = append(pauses, Pause{
+			Direction: direction,
+			Path:      pausePath,
+			Reason:    strings.TrimSpace(string(content)),
+		})
+	}
+
+	return pauses, nil
+}
+
+// Confirm allows the deletions of a paused direction, which resumes
+func (p Pause) Confirm() error {
+	err := os.Remove(p.Path)
+	if err != nil && !os.IsNotExist(err) {
+		return errors.Wrap(err, "can't remove pause file")
+	}
+
+	return nil
+}
+
+// deletionGuard counts the deletions of one direction within the time window
+type deletionGuard struct {
+	deletions []deletion
+	direction string
+	logger    *logrus.Entry
+	mutex     gosync.Mutex
+}
+
+// deletion represents files deleted at once
+type deletion struct {
+	at    time.Time
+	count int
+}
+
+func newDeletionGuard(logger *logrus.Entry, direction string) *deletionGuard {
+	return &deletionGuard{direction: direction, logger: logger}
+}
+
+// allowDeletion waits until a deletion of files of the given direction is
+// allowed. Once the limit is reached, the direction is paused, along with the
+// changes after it, until the deletions are confirmed with the CLI
+func (s *Sync) allowDeletion(ctx context.Context, guard *deletionGuard, relativePath string) error {
+	if s.PauseFolder == "" {
+		return nil
+	}
+
+	guard.mutex.Lock()
+	defer guard.mutex.Unlock()
+
+	pausePath := path.Join(s.PauseFolder, guard.direction)
+	if pathExists(pausePath) {
+		guard.logger.Errorf("deletions paused. run `dropbox_sync deletions confirm` to resume")
+
+		err := waitForConfirmation(ctx, pausePath)
+		if err != nil {
+			return err
+		}
+		guard.deletions = nil
+	}
+
+	count := s.treeSize(relativePath)
+	now := time.Now()
+
+	recent := guard.deletions[:0]
+	total := count
+	for _, previous := range guard.deletions {
+		if now.Sub(previous.at) < s.DeletionLimit.Window {
+			recent = append(recent, previous)
+			total += previous.count
+		}
+	}
+	guard.deletions = recent
+
+	// deleted paths already left the state, so they are counted back in the folder size
+	folderSize := s.State.Len() + total - count
+	reason := s.DeletionLimit.exceeded(total, folderSize)
+	if reason != "" {
+		guard.logger.Errorf("%s. deletions paused. run `dropbox_sync deletions confirm` to resume", reason)
+
+		err := os.MkdirAll(s.PauseFolder, 0700)
+		if err == nil {
+			err = ioutil.WriteFile(pausePath, []byte(fmt.Sprintf("%s: %s\n", now.Format(time.RFC3339), reason)), 0600)
+		}
+
+		if err != nil {
+			return errors.Wrap(err, "can't write pause file")
+		}
+
+		err = waitForConfirmation(ctx, pausePath)
+		if err != nil {
+			return err
+		}
+		guard.logger.Infof("deletions confirmed. resume")
+		guard.deletions = nil
+	}
+
+	guard.deletions = append(guard.deletions, deletion{at: now, count: count})
+
+	return nil
+}
+
+// exceeded describes why deleting a number of files from a folder goes over the
+// limit, or returns an empty string when it doesn't
+func (l DeletionLimit) exceeded(count int, folderSize int) string {
+	if l.Count > 0 && count > l.Count {
+		return fmt.Sprintf("%d files deleted within %s, more than %d", count, l.Window, l.Count)
+	}
+
+	if l.Percent > 0 && count > minimumPercentDeletions && folderSize > 0 && count*100 > l.Percent*folderSize {
+		return fmt.Sprintf("%d of %d files deleted within %s, more than %d%%", count, folderSize, l.Window, l.Percent)
+	}
+
+	return ""
+}
+
+// treeSize returns the number of synchronized paths a deletion removes
+func (s *Sync) treeSize(relativePath string) int {
+	count := 0
+	for _, candidate := range s.State.Paths() {
+		if candidate == relativePath || strings.HasPrefix(candidate, relativePath+"/") {
+			count++
+		}
+	}
+
+	if count == 0 {
+		return 1
+	}
+
+	return count
+}
+
+// waitForConfirmation blocks until the pause file has been removed
+func waitForConfirmation(ctx context.Context, pausePath string) error {
+	for pathExists(pausePath) {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(pauseCheckInterval):
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,169 @@
+package sync
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/kdisneur/dropbox_sync/pkg/state"
+	"github.com/sirupsen/logrus"
+)
+
+func TestDeletionLimitExceeded(t *testing.T) {
+	tests := []struct {
+		limit      DeletionLimit
+		count      int
+		folderSize int
+		exceeded   bool
+	}{
+		{DeletionLimit{Count: 5}, 5, 1000, false},
+		{DeletionLimit{Count: 5}, 6, 1000, true},
+		{DeletionLimit{Percent: 50}, 50, 100, false},
+		{DeletionLimit{Percent: 50}, 51, 100, true},
+		// small folders can be emptied
+		{DeletionLimit{Percent: 50}, minimumPercentDeletions, minimumPercentDeletions, false},
+		{DeletionLimit{Percent: 50}, minimumPercentDeletions + 1, minimumPercentDeletions + 1, true},
+		{DeletionLimit{Percent: 50}, 20, 0, false},
+		{DeletionLimit{Count: 5, Percent: 50}, 6, 1000, true},
+		{DeletionLimit{Count: 500, Percent: 50}, 60, 100, true},
+		{DeletionLimit{}, 10000, 10000, false},
+	}
+
+	for _, test := range tests {
+		reason := test.limit.exceeded(test.count, test.folderSize)
+		if (reason != "") != test.exceeded {
+			t.Errorf("expected %+v to be exceeded by %d of %d files: %t, got '%s'", test.limit, test.count, test.folderSize, test.exceeded, reason)
+		}
+	}
+}
+
+func TestAllowDeletion(t *testing.T) {
+	logrus.SetOutput(ioutil.Discard)
+
+	folder, err := ioutil.TempDir("", "dropbox_sync")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(folder)
+
+	store, err := state.Open(filepath.Join(folder, "state.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	for i := 0; i < 100; i++ {
+		err = store.Put(fmt.Sprintf("/folder/%d", i), state.Entry{})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	s := &Sync{
+		DeletionLimit: DeletionLimit{Count: 5, Window: time.Minute},
+		PauseFolder:   filepath.Join(folder, "pauses"),
+		State:         store,
+	}
+	guard := newDeletionGuard(logrus.NewEntry(logrus.StandardLogger()), DirectionLocalToDropbox)
+
+	if size := s.treeSize("/folder"); size != 100 {
+		t.Fatalf("expected a folder deletion to count its whole tree, got %d", size)
+	}
+
+	for i := 0; i < 5; i++ {
+		err = s.allowDeletion(context.Background(), guard, fmt.Sprintf("/folder/%d", i))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	err = s.allowDeletion(ctx, guard, "/folder/5")
+	if err != context.DeadlineExceeded {
+		t.Fatalf("expected the deletion beyond the limit to wait, got %v", err)
+	}
+
+	pauses, err := Pauses(s.PauseFolder)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(pauses) != 1 || pauses[0].Direction != DirectionLocalToDropbox || pauses[0].Reason == "" {
+		t.Fatalf("expected the direction to be paused, got %+v", pauses)
+	}
+
+	allowed := make(chan error)
+	go func() {
+		allowed <- s.allowDeletion(context.Background(), guard, "/folder/5")
+	}()
+
+	// the deletion pauses again when it only starts after the confirmation
+	timeout := time.After(5 * pauseCheckInterval)
+	for resumed := false; !resumed; {
+		err = pauses[0].Confirm()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		select {
+		case err = <-allowed:
+			if err != nil {
+				t.Fatal(err)
+			}
+			resumed = true
+		case <-time.After(100 * time.Millisecond):
+		case <-timeout:
+			t.Fatalf("expected the deletion to resume once confirmed")
+		}
+	}
+
+	// the confirmed deletions don't count anymore
+	err = s.allowDeletion(context.Background(), guard, "/folder/6")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pauses, err = Pauses(s.PauseFolder)
+	if err != nil || len(pauses) != 0 {
+		t.Fatalf("expected no direction to be paused, got %+v (%v)", pauses, err)
+	}
+}
+
+func TestAllowDeletionWindow(t *testing.T) {
+	folder, err := ioutil.TempDir("", "dropbox_sync")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(folder)
+
+	store, err := state.Open(filepath.Join(folder, "state.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	s := &Sync{
+		DeletionLimit: DeletionLimit{Count: 2, Window: 10 * time.Millisecond},
+		PauseFolder:   filepath.Join(folder, "pauses"),
+		State:         store,
+	}
+	guard := newDeletionGuard(logrus.NewEntry(logrus.StandardLogger()), DirectionDropboxToLocal)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	for i := 0; i < 5; i++ {
+		err = s.allowDeletion(ctx, guard, fmt.Sprintf("/%d", i))
+		if err != nil {
+			t.Fatalf("expected the deletions older than the window not to count, got %v", err)
+		}
+
+		time.Sleep(20 * time.Millisecond)
+	}
+}
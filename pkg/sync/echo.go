@@ -0,0 +1,137 @@
+package sync
+
+import (
+	"os"
+	"strings"
+	gosync "sync"
+	"time"
+
+	"github.com/kdisneur/dropbox_sync/pkg/dropbox"
+	"github.com/kdisneur/dropbox_sync/pkg/local"
+)
+
+const (
+	localEchoTTL   = time.Minute
+	dropboxEchoTTL = 5 * time.Minute
+)
+
+// echo represents a change the synchronizer did itself and expects to be notified about
+type echo struct {
+	deleted bool
+	expires time.Time
+	folder  bool
+	modTime time.Time
+	rev     string
+	size    int64
+}
+
+// echoTracker keeps the changes done on one side so their notifications are not
+// replayed on the other side
+type echoTracker struct {
+	entries map[string]echo
+	mutex   gosync.Mutex
+	ttl     time.Duration
+}
+
+func newEchoTracker(ttl time.Duration) *echoTracker {
+	return &echoTracker{entries: make(map[string]echo), ttl: ttl}
+}
+
+// expect records a change done on a path. A deletion replaces the changes
+// recorded below the path, which can't be notified anymore
+func (e *echoTracker) expect(relativePath string, expected echo) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	now := time.Now()
+	for candidate, entry := range e.entries {
+		below := expected.deleted && strings.HasPrefix(candidate, relativePath+"/")
+		if below || now.After(entry.expires) {
+			delete(e.entries, candidate)
+		}
+	}
+
+	expected.expires = now.Add(e.ttl)
+	e.entries[relativePath] = expected
+}
+
+// match reports whether a notification corresponds to a recorded change. When
+// consume is true, the recorded change is forgotten once matched
+func (e *echoTracker) match(relativePath string, consume bool, matches func(echo) bool) bool {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	expected, ok := e.entries[relativePath]
+	if !ok || time.Now().After(expected.expires) || !matches(expected) {
+		return false
+	}
+
+	if consume {
+		delete(e.entries, relativePath)
+	}
+
+	return true
+}
+
+// forget drops the change recorded on a path
+func (e *echoTracker) forget(relativePath string) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	delete(e.entries, relativePath)
+}
+
+// expectLocalWrite records a file or folder written locally by the synchronizer
+func (s *Sync) expectLocalWrite(relativePath string, localPath string) {
+	info, err := os.Stat(localPath)
+	if err != nil {
+		return
+	}
+
+	s.localEchoes.expect(relativePath, echo{folder: info.IsDir(), modTime: info.ModTime(), size: info.Size()})
+}
+
+// isLocalEcho reports whether a local action has been caused by the synchronizer itself.
+// A single write triggers several events so the recorded write is kept until it
+// expires, while a deletion is forgotten once notified. Any other change of the
+// path makes the recorded one outdated
+func (s *Sync) isLocalEcho(action *local.Action) bool {
+	deletion := action.Type == local.ActionTypeDelete
+
+	matched := s.localEchoes.match(action.File.RelativePath, deletion, func(expected echo) bool {
+		if action.Type == local.ActionTypeDelete {
+			return expected.deleted
+		}
+
+		info, err := os.Stat(action.File.Path)
+		if err != nil || expected.deleted {
+			return false
+		}
+
+		if info.IsDir() {
+			return expected.folder
+		}
+
+		return info.Size() == expected.size && info.ModTime().Equal(expected.modTime)
+	})
+
+	if !matched && action.Type == local.ActionTypeCreate {
+		s.localEchoes.forget(action.File.RelativePath)
+	}
+
+	return matched
+}
+
+// isDropboxEcho reports whether a Dropbox action has been caused by the synchronizer itself
+func (s *Sync) isDropboxEcho(action *dropbox.Action) bool {
+	return s.dropboxEchoes.match(action.File.RelativePath, true, func(expected echo) bool {
+		switch {
+		case action.Type == dropbox.ActionTypeDelete:
+			return expected.deleted
+		case action.File.Type == dropbox.FileTypeFolder:
+			return expected.folder
+		default:
+			return expected.rev != "" && expected.rev == action.File.Rev
+		}
+	})
+}
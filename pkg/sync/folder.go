@@ -0,0 +1,227 @@
+package sync
+
+import (
+	"context"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/kdisneur/dropbox_sync/pkg/dropbox"
+	"github.com/kdisneur/dropbox_sync/pkg/ignore"
+	"github.com/kdisneur/dropbox_sync/pkg/local"
+)
+
+// deleteDropboxFolder deletes a folder from Dropbox. Ignored paths are never
+// deleted, and neither are the paths changed on Dropbox since the last
+// synchronization, which are downloaded again instead. When the folder holds
+// some of them, its content is deleted path by path and the folders above the
+// kept paths remain
+func (s *Sync) deleteDropboxFolder(ctx context.Context, relativePath string) error {
+	remotes, ignored, err := s.remoteTree(ctx, relativePath)
+	if dropbox.IsNotFound(err) {
+		return s.State.Delete(relativePath)
+	}
+
+	if err != nil {
+		return err
+	}
+
+	tree := &reconciledTree{remotes: remotes}
+	if len(ignored) == 0 && (s.Mode == ModeMirrorLocal || s.remoteTreeUnchanged(tree, relativePath)) {
+		return s.deleteDropboxPath(ctx, relativePath)
+	}
+
+	var changed []string
+	if s.Mode != ModeMirrorLocal {
+		for candidate, remote := range remotes {
+			base, known := s.State.Get(candidate)
+			if !known || !remoteUnchangedSince(base, remote) {
+				changed = append(changed, candidate)
+			}
+		}
+	}
+	kept := append(changed, ignored...)
+
+	s.LocalLogger.Warnf("folder holds paths changed on Dropbox since last synchronization or ignored. keep them (%s)", relativePath)
+
+	var deleted []string
+	for _, candidate := range sortedPaths(remotes) {
+		if isBelowAny(candidate, deleted) || isAny(candidate, changed) || isAboveAny(candidate, kept) {
+			continue
+		}
+
+		err = s.deleteDropboxPath(ctx, candidate)
+		if err != nil {
+			return err
+		}
+		deleted = append(deleted, candidate)
+	}
+
+	sort.Strings(changed)
+	for _, candidate := range changed {
+		err = s.applyDropboxCreation(ctx, remotes[candidate])
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// removeLocalFolder moves a local folder to the trash, except the paths changed
+// since the last synchronization, which are uploaded again instead. When the
+// folder holds some of them, its content is removed path by path and the
+// folders above the kept paths remain
+func (s *Sync) removeLocalFolder(ctx context.Context, relativePath string) error {
+	folderPath := path.Join(s.LocalBasePath, relativePath)
+
+	files, err := local.WalkFrom(s.LocalBasePath, folderPath, s.Ignore)
+	if err != nil {
+		return err
+	}
+
+	tree := &reconciledTree{locals: make(map[string]local.File, len(files))}
+	for _, file := range files {
+		tree.locals[file.RelativePath] = file
+	}
+
+	if s.localTreeUnchanged(tree, relativePath) {
+		return s.removeLocalPath(relativePath)
+	}
+
+	var changed []string
+	for _, file := range files {
+		if !s.localUnchangedSince(file) {
+			changed = append(changed, file.RelativePath)
+		}
+	}
+
+	s.DropboxLogger.Warnf("folder holds paths changed locally since last synchronization. keep them (%s)", relativePath)
+
+	kept := []local.File{{Path: folderPath, RelativePath: relativePath, Type: local.FileTypeFolder}}
+	var removed []string
+	for _, file := range files {
+		if isBelowAny(file.RelativePath, removed) {
+			continue
+		}
+
+		if isAny(file.RelativePath, changed) || isAboveAny(file.RelativePath, changed) {
+			kept = append(kept, file)
+			continue
+		}
+
+		err = s.removeLocalPath(file.RelativePath)
+		if err != nil {
+			return err
+		}
+		removed = append(removed, file.RelativePath)
+	}
+
+	// Dropbox doesn't hold the folder anymore, so nothing left in it is synchronized
+	err = s.State.Delete(relativePath)
+	if err != nil || !s.Mode.uploads() {
+		return err
+	}
+
+	for _, file := range kept {
+		err = s.applyLocalCreation(ctx, file)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// removeLocalPath moves a file, or a folder with everything it contains except
+// the ignored paths, to the trash
+func (s *Sync) removeLocalPath(relativePath string) error {
+	filePath := path.Join(s.LocalBasePath, relativePath)
+
+	err := s.removeLocalTree(filePath)
+	if err != nil {
+		return err
+	}
+	s.localEchoes.expect(relativePath, echo{deleted: true})
+
+	if ignore.IsIgnoreFile(filePath) {
+		s.Ignore.Reload(path.Dir(relativePath))
+	}
+
+	return s.State.Delete(relativePath)
+}
+
+// deleteDropboxPath deletes a file, or a folder with everything it contains, from Dropbox
+func (s *Sync) deleteDropboxPath(ctx context.Context, relativePath string) error {
+	err := dropbox.FileDelete(ctx, *s.Client, path.Join(s.RemoteBasePath, relativePath))
+	if err != nil {
+		return err
+	}
+	s.dropboxEchoes.expect(relativePath, echo{deleted: true})
+
+	return s.State.Delete(relativePath)
+}
+
+// remoteTree lists everything a Dropbox folder contains, keyed by their path
+// relative to the synchronized folder. The ignored paths are returned apart
+func (s *Sync) remoteTree(ctx context.Context, relativePath string) (map[string]dropbox.File, []string, error) {
+	scanner := dropbox.NewScanner(s.DropboxLogger, *s.Client, path.Join(s.RemoteBasePath, relativePath), nil, nil)
+
+	files, err := scanner.InitialListing(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	remotes := make(map[string]dropbox.File, len(files))
+	var ignored []string
+
+	for _, file := range files {
+		if file.RelativePath == "" {
+			continue
+		}
+
+		file.RelativePath = relativePath + file.RelativePath
+		if s.Ignore.Match(file.RelativePath, file.Type == dropbox.FileTypeFolder) {
+			ignored = append(ignored, file.RelativePath)
+			continue
+		}
+
+		remotes[file.RelativePath] = file
+	}
+
+	return remotes, ignored, nil
+}
+
+// sortedPaths returns the paths of a tree, parents first
+func sortedPaths(files map[string]dropbox.File) []string {
+	paths := make([]string, 0, len(files))
+	for relativePath := range files {
+		paths = append(paths, relativePath)
+	}
+
+	sort.Strings(paths)
+
+	return paths
+}
+
+// isAny reports whether a path is one of the paths
+func isAny(relativePath string, relativePaths []string) bool {
+	for _, candidate := range relativePaths {
+		if candidate == relativePath {
+			return true
+		}
+	}
+
+	return false
+}
+
+// isAboveAny reports whether a folder holds one of the paths
+func isAboveAny(folder string, relativePaths []string) bool {
+	for _, relativePath := range relativePaths {
+		if strings.HasPrefix(relativePath, folder+"/") {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,241 @@
+package sync
+
+import (
+	"context"
+	"os"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/kdisneur/dropbox_sync/pkg/dropbox"
+	"github.com/kdisneur/dropbox_sync/pkg/local"
+)
+
+// Mode represents which side changes are propagated from
+type Mode string
+
+const (
+	// ModeSync propagates changes in both directions
+	ModeSync Mode = "sync"
+	// ModeBackup uploads local changes to Dropbox but never deletes Dropbox files
+	ModeBackup Mode = "backup"
+	// ModeDownload applies Dropbox changes locally and keeps local changes on this computer
+	ModeDownload Mode = "download"
+	// ModeMirrorDropbox forces the local folder to match Dropbox, reverting local changes
+	ModeMirrorDropbox Mode = "mirror-dropbox"
+	// ModeMirrorLocal forces the Dropbox folder to match the local one, reverting Dropbox changes
+	ModeMirrorLocal Mode = "mirror-local"
+)
+
+// uploads reports whether local changes are propagated to Dropbox
+func (m Mode) uploads() bool {
+	return m == ModeSync || m == ModeBackup || m == ModeMirrorLocal
+}
+
+// downloads reports whether Dropbox changes are propagated locally
+func (m Mode) downloads() bool {
+	return m == ModeSync || m == ModeDownload || m == ModeMirrorDropbox
+}
+
+// revertLocalChange restores a path changed locally to what Dropbox has, as
+// recorded in the state. Paths unknown to Dropbox are removed
+func (s *Sync) revertLocalChange(ctx context.Context, relativePath string) error {
+	filePath := path.Join(s.LocalBasePath, relativePath)
+
+	if _, known := s.State.Get(relativePath); !known {
+		if !pathExists(filePath) {
+			return nil
+		}
+
+		err := s.allowDeletion(ctx, s.dropboxDeletions, relativePath)
+		if err != nil {
+			return err
+		}
+
+		s.LocalLogger.Infof("mirror of Dropbox. remove local change (%s)", relativePath)
+		s.localEchoes.expect(relativePath, echo{deleted: true})
+
+		return s.removeLocalTree(filePath)
+	}
+
+	s.LocalLogger.Infof("mirror of Dropbox. restore Dropbox version (%s)", relativePath)
+
+	var paths []string
+	for _, candidate := range s.State.Paths() {
+		if candidate == relativePath || strings.HasPrefix(candidate, relativePath+"/") {
+			paths = append(paths, candidate)
+		}
+	}
+	sort.Strings(paths)
+
+	for _, candidate := range paths {
+		entry, known := s.State.Get(candidate)
+		if !known {
+			continue
+		}
+
+		if !entry.Folder {
+			err := s.State.Delete(candidate)
+			if err != nil {
+				return err
+			}
+		}
+
+		err := s.applyDropboxCreation(ctx, s.remoteFromEntry(candidate, entry))
+		if err != nil {
+			return err
+		}
+		s.LocalScanner.NotifyCreation(candidate)
+	}
+
+	return nil
+}
+
+// revertDropboxChange restores a path changed on Dropbox to the local version.
+// Paths missing locally are removed from Dropbox
+func (s *Sync) revertDropboxChange(ctx context.Context, relativePath string) error {
+	filePath := path.Join(s.LocalBasePath, relativePath)
+
+	info, err := os.Lstat(filePath)
+	if os.IsNotExist(err) {
+		err = s.allowDeletion(ctx, s.localDeletions, relativePath)
+		if err != nil {
+			return err
+		}
+
+		s.DropboxLogger.Infof("mirror of local folder. remove Dropbox change (%s)", relativePath)
+
+		err = dropbox.FileDelete(ctx, *s.Client, path.Join(s.RemoteBasePath, relativePath))
+		if err != nil && !dropbox.IsNotFound(err) {
+			return err
+		}
+		s.dropboxEchoes.expect(relativePath, echo{deleted: true})
+
+		return s.State.Delete(relativePath)
+	}
+
+	if err != nil {
+		return err
+	}
+
+	s.DropboxLogger.Infof("mirror of local folder. restore local version (%s)", relativePath)
+
+	err = s.State.Delete(relativePath)
+	if err != nil {
+		return err
+	}
+
+	file := local.File{Path: filePath, RelativePath: relativePath, Type: local.FileTypeFile}
+	if info.IsDir() {
+		file.Type = local.FileTypeFolder
+	}
+
+	return s.applyLocalTreeCreation(ctx, file)
+}
+
+// reconcileMirrorDropbox converges a single path to its Dropbox version and
+// reports whether it has been deleted
+func (s *Sync) reconcileMirrorDropbox(ctx context.Context, relativePath string, remote dropbox.File, remoteExists bool, localFile local.File, localExists bool) (bool, error) {
+	base, known := s.State.Get(relativePath)
+
+	switch {
+	case remoteExists:
+		if known && localExists && unchangedSince(base, remote, localFile) {
+			return false, nil
+		}
+
+		if known && !base.Folder {
+			err := s.State.Delete(relativePath)
+			if err != nil {
+				return false, err
+			}
+		}
+
+		return false, s.applyDropboxCreation(ctx, remote)
+	case localExists:
+		err := s.allowDeletion(ctx, s.dropboxDeletions, relativePath)
+		if err != nil {
+			return false, err
+		}
+
+		s.LocalLogger.Infof("mirror of Dropbox. remove local change (%s)", relativePath)
+
+		err = s.removeLocalTree(localFile.Path)
+		if err != nil {
+			return false, err
+		}
+
+		return true, s.State.Delete(relativePath)
+	default:
+		return true, s.State.Delete(relativePath)
+	}
+}
+
+// reconcileMirrorLocal converges a single path to its local version and reports
+// whether it has been deleted
+func (s *Sync) reconcileMirrorLocal(ctx context.Context, relativePath string, remote dropbox.File, remoteExists bool, localFile local.File, localExists bool) (bool, error) {
+	base, known := s.State.Get(relativePath)
+
+	switch {
+	case localExists:
+		if known && remoteExists && unchangedSince(base, remote, localFile) {
+			return false, nil
+		}
+
+		if known && !base.Folder {
+			err := s.State.Delete(relativePath)
+			if err != nil {
+				return false, err
+			}
+		}
+
+		return false, s.applyLocalCreation(ctx, localFile)
+	case remoteExists:
+		s.DropboxLogger.Infof("mirror of local folder. remove Dropbox change (%s)", relativePath)
+
+		return true, s.applyLocalDeletion(ctx, local.File{Path: path.Join(s.LocalBasePath, relativePath), RelativePath: relativePath})
+	default:
+		return true, s.State.Delete(relativePath)
+	}
+}
+
+// revertDropboxAction undoes a change done on Dropbox by someone else
+func (s *Sync) revertDropboxAction(ctx context.Context, action *dropbox.Action) error {
+	if action.Type == dropbox.ActionTypeMove {
+		err := s.revertDropboxChange(ctx, action.Source.RelativePath)
+		if err != nil {
+			return err
+		}
+	}
+
+	return s.revertDropboxChange(ctx, action.File.RelativePath)
+}
+
+// revertLocalAction undoes a change done on the local folder by someone else
+func (s *Sync) revertLocalAction(ctx context.Context, action *local.Action) error {
+	if action.Type == local.ActionTypeMove {
+		err := s.revertLocalChange(ctx, action.Source.RelativePath)
+		if err != nil {
+			return err
+		}
+	}
+
+	return s.revertLocalChange(ctx, action.File.RelativePath)
+}
+
+// clearMirroredPath removes a local file standing where Dropbox has a folder, or a
+// local folder standing where Dropbox has a file, when mirroring Dropbox
+func (s *Sync) clearMirroredPath(filePath string, folder bool) error {
+	if s.Mode != ModeMirrorDropbox {
+		return nil
+	}
+
+	info, err := os.Lstat(filePath)
+	if err != nil || info.IsDir() == folder {
+		return nil
+	}
+
+	s.localEchoes.expect(relativePath(s.LocalBasePath, filePath), echo{deleted: true})
+
+	return s.removeLocalTree(filePath)
+}
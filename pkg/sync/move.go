@@ -0,0 +1,161 @@
+package sync
+
+import (
+	"context"
+	"os"
+	"path"
+
+	"github.com/kdisneur/dropbox_sync/pkg/dropbox"
+	"github.com/kdisneur/dropbox_sync/pkg/local"
+	"github.com/kdisneur/dropbox_sync/pkg/state"
+)
+
+// applyDropboxMove renames the local file instead of downloading it again. It
+// falls back to a deletion and a creation when the local file can't be moved
+func (s *Sync) applyDropboxMove(ctx context.Context, source dropbox.File, file dropbox.File) error {
+	sourcePath := path.Join(s.LocalBasePath, source.RelativePath)
+	filePath := path.Join(s.LocalBasePath, file.RelativePath)
+
+	base, known := s.State.Get(source.RelativePath)
+	info, err := os.Stat(sourcePath)
+	if err != nil || !known || pathExists(filePath) {
+		s.DropboxLogger.Debugf("can't move local file. delete and create it instead (%s)", sourcePath)
+
+		err = s.applyDropboxDeletion(ctx, source)
+		if err != nil {
+			return err
+		}
+
+		return s.applyDropboxCreation(ctx, file)
+	}
+
+	if !info.IsDir() {
+		localSum, err := s.localHash(sourcePath)
+		if (err != nil || localSum != base.ContentHash) && s.Mode == ModeMirrorDropbox {
+			err = s.applyDropboxDeletion(ctx, source)
+			if err != nil {
+				return err
+			}
+
+			return s.applyDropboxCreation(ctx, file)
+		}
+
+		if err != nil || localSum != base.ContentHash {
+			s.DropboxLogger.Warnf("file changed locally since last synchronization. keep it (%s)", sourcePath)
+
+			err = s.State.Delete(source.RelativePath)
+			if err != nil {
+				return err
+			}
+
+			return s.applyDropboxCreation(ctx, file)
+		}
+	}
+
+	err = os.MkdirAll(path.Dir(filePath), 0750)
+	if err != nil {
+		return err
+	}
+
+	err = os.Rename(sourcePath, filePath)
+	if err != nil {
+		return err
+	}
+	s.localEchoes.expect(source.RelativePath, echo{deleted: true})
+	s.expectLocalWrite(file.RelativePath, filePath)
+
+	err = s.State.Move(source.RelativePath, file.RelativePath)
+	if err != nil {
+		return err
+	}
+
+	if file.Type == dropbox.FileTypeFolder {
+		return s.State.Put(file.RelativePath, state.Entry{ID: file.ID, Folder: true})
+	}
+
+	return s.recordDropboxFile(file, filePath)
+}
+
+// applyLocalMove moves the Dropbox file instead of uploading it again. It falls
+// back to a deletion and an upload when the Dropbox file can't be moved. In
+// backup mode, the file is uploaded again and the Dropbox one is kept
+func (s *Sync) applyLocalMove(ctx context.Context, source local.File, file local.File) error {
+	if s.Mode == ModeBackup {
+		err := s.State.Delete(source.RelativePath)
+		if err != nil {
+			return err
+		}
+
+		return s.applyLocalTreeCreation(ctx, file)
+	}
+
+	base, known := s.State.Get(source.RelativePath)
+	if !known {
+		if _, moved := s.State.Get(file.RelativePath); moved {
+			s.LocalLogger.Debugf("file already moved. skip move (%s)", file.Path)
+			return nil
+		}
+
+		s.LocalLogger.Debugf("file never synchronized. upload it (%s)", file.Path)
+		return s.applyLocalTreeCreation(ctx, file)
+	}
+
+	moved, err := dropbox.FileMove(
+		ctx,
+		*s.Client,
+		path.Join(s.RemoteBasePath, source.RelativePath),
+		path.Join(s.RemoteBasePath, file.RelativePath),
+	)
+
+	if err != nil {
+		s.LocalLogger.Warnf("can't move file on Dropbox. delete and upload it instead (%s): %s", file.Path, err)
+
+		err = s.applyLocalDeletion(ctx, source)
+		if err != nil {
+			return err
+		}
+
+		return s.applyLocalTreeCreation(ctx, file)
+	}
+	s.dropboxEchoes.expect(source.RelativePath, echo{deleted: true})
+	s.dropboxEchoes.expect(file.RelativePath, echo{folder: base.Folder, rev: moved.Rev})
+
+	err = s.State.Move(source.RelativePath, file.RelativePath)
+	if err != nil {
+		return err
+	}
+
+	if base.Folder {
+		return s.State.Put(file.RelativePath, state.Entry{ID: moved.ID, Folder: true})
+	}
+
+	return s.recordDropboxFile(*moved, file.Path)
+}
+
+// applyLocalTreeCreation uploads a file or a folder with everything it contains
+func (s *Sync) applyLocalTreeCreation(ctx context.Context, file local.File) error {
+	err := s.applyLocalCreation(ctx, file)
+	if err != nil || file.Type != local.FileTypeFolder {
+		return err
+	}
+
+	files, err := local.WalkFrom(s.LocalBasePath, file.Path, s.Ignore)
+	if err != nil {
+		return err
+	}
+
+	for _, child := range files {
+		err = s.applyLocalCreation(ctx, child)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func pathExists(filePath string) bool {
+	_, err := os.Lstat(filePath)
+
+	return err == nil
+}
@@ -0,0 +1,475 @@
+package sync
+
+import (
+	"context"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	gosync "sync"
+	"sync/atomic"
+
+	"github.com/kdisneur/dropbox_sync/pkg/dropbox"
+	"github.com/kdisneur/dropbox_sync/pkg/local"
+	"github.com/kdisneur/dropbox_sync/pkg/state"
+)
+
+// Reconcile compares the whole local folder with the whole Dropbox folder and
+// applies the uploads, downloads and deletions needed to converge. It is meant to
+// run once on startup, before the scanners start watching for changes
+func (s *Sync) Reconcile(ctx context.Context) (err error) {
+	operations := newOperationGroup()
+	defer drain(operations, &err)
+
+	s.DropboxLogger.Infof("reconcile Dropbox folder '%s' with local '%s' path", s.RemoteBasePath, s.LocalBasePath)
+
+	err = s.applySelection()
+	if err != nil {
+		return err
+	}
+
+	err = s.applyIgnoreRules()
+	if err != nil {
+		return err
+	}
+
+	remoteFiles, err := s.remoteFiles(ctx)
+	if err != nil {
+		return err
+	}
+
+	localFiles, err := local.Walk(s.LocalBasePath, s.Ignore)
+	if err != nil {
+		return err
+	}
+
+	tree := &reconciledTree{
+		locals:  make(map[string]local.File, len(localFiles)),
+		remotes: make(map[string]dropbox.File, len(remoteFiles)),
+	}
+
+	for _, file := range remoteFiles {
+		if file.RelativePath != "" {
+			tree.remotes[file.RelativePath] = file
+		}
+	}
+
+	for _, file := range localFiles {
+		tree.locals[file.RelativePath] = file
+	}
+
+	// paths are scheduled parents first and wait for their parents, so a deleted
+	// folder is known before its content is reconciled
+	var deletedFolders []string
+	var deletedMutex gosync.Mutex
+	var failed int32
+
+	for _, relativePath := range s.reconciledPaths(tree) {
+		relativePath := relativePath
+		remote, remoteExists := tree.remotes[relativePath]
+		localFile, localExists := tree.locals[relativePath]
+
+		kind := transferUpload
+		if remoteExists {
+			kind = transferDownload
+		}
+
+		err := s.operations().schedule(ctx, operations, kind, schedulingPaths(relativePath), func() error {
+			deletedMutex.Lock()
+			below := isBelowAny(relativePath, deletedFolders)
+			deletedMutex.Unlock()
+
+			if below {
+				return nil
+			}
+
+			if s.isIgnored(relativePath, remote, remoteExists, localFile, localExists) {
+				s.DropboxLogger.Debugf("ignored path. skip (%s)", relativePath)
+				return nil
+			}
+
+			deleted, err := s.reconcilePath(ctx, tree, relativePath, remote, remoteExists, localFile, localExists)
+			if err != nil && ctx.Err() != nil {
+				return err
+			}
+
+			if err != nil {
+				// a path failing doesn't prevent the others from converging, it is
+				// reconciled again on the next run
+				s.DropboxLogger.Errorf("can't reconcile path. skip (%s): %s", relativePath, err)
+				atomic.StoreInt32(&failed, 1)
+				return nil
+			}
+
+			if deleted {
+				deletedMutex.Lock()
+				deletedFolders = append(deletedFolders, relativePath)
+				deletedMutex.Unlock()
+			}
+
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	err = operations.wait()
+	if err != nil {
+		return err
+	}
+
+	if atomic.LoadInt32(&failed) == 0 {
+		atomic.StoreInt32(&s.unreconciled, 0)
+		return nil
+	}
+
+	// the Dropbox changes of the failed paths are behind the cursor, so the next run
+	// has to list the whole folder to find them again
+	s.DropboxLogger.Warnf("some paths can't be reconciled. list the whole Dropbox folder on next run")
+	atomic.StoreInt32(&s.unreconciled, 1)
+
+	return s.State.SetCursor("")
+}
+
+// requestReconcile asks for the whole folder to be reconciled again, once the
+// changes followed are done
+func (s *Sync) requestReconcile() {
+	select {
+	case s.reconcileRequests <- struct{}{}:
+	default:
+	}
+}
+
+// watchReconcile calls `stop` once the whole folder has to be reconciled again,
+// because an ignore file changed the rules the folder is synchronized with or
+// because it has been requested, until the context is done. The returned channel
+// is closed when the watch ends and holds true when a reconcile is needed
+func (s *Sync) watchReconcile(ctx context.Context, stop func()) <-chan bool {
+	needed := make(chan bool, 1)
+
+	go func() {
+		defer close(needed)
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-s.reconcileRequests:
+				needed <- true
+				stop()
+				return
+			case <-s.Ignore.Changed():
+				if s.Ignore.Fingerprint() != s.State.IgnoreRules() {
+					s.DropboxLogger.Infof("ignore rules changed. reconcile the whole folder")
+					needed <- true
+					stop()
+					return
+				}
+			}
+		}
+	}()
+
+	return needed
+}
+
+// reconciledTree represents the paths found on both sides when reconciling
+type reconciledTree struct {
+	locals  map[string]local.File
+	remotes map[string]dropbox.File
+}
+
+// reconcilePath converges a single path and reports whether it has been deleted
+// on either side. A folder deleted on one side is deleted on the other one only
+// when none of its content changed since the last synchronization, otherwise its
+// content is reconciled path by path
+func (s *Sync) reconcilePath(ctx context.Context, tree *reconciledTree, relativePath string, remote dropbox.File, remoteExists bool, localFile local.File, localExists bool) (bool, error) {
+	switch s.Mode {
+	case ModeMirrorDropbox:
+		return s.reconcileMirrorDropbox(ctx, relativePath, remote, remoteExists, localFile, localExists)
+	case ModeMirrorLocal:
+		return s.reconcileMirrorLocal(ctx, relativePath, remote, remoteExists, localFile, localExists)
+	}
+
+	base, known := s.State.Get(relativePath)
+
+	switch {
+	case remoteExists && localExists:
+		if known && unchangedSince(base, remote, localFile) {
+			return false, nil
+		}
+
+		if s.Mode.downloads() {
+			err := s.applyDropboxCreation(ctx, remote)
+			if err != nil {
+				return false, err
+			}
+		}
+
+		if !s.Mode.uploads() {
+			return false, nil
+		}
+
+		return false, s.applyLocalCreation(ctx, localFile)
+	case remoteExists:
+		unchanged := remoteUnchangedSince(base, remote)
+		if known && unchanged && s.Mode == ModeDownload {
+			s.LocalLogger.Debugf("deleted while not running. download it again (%s)", relativePath)
+
+			err := s.State.Delete(relativePath)
+			if err != nil {
+				return false, err
+			}
+
+			return false, s.applyDropboxCreation(ctx, remote)
+		}
+
+		if known && unchanged && base.Folder && !s.remoteTreeUnchanged(tree, relativePath) {
+			s.LocalLogger.Debugf("deleted while not running but changed on Dropbox. reconcile its content (%s)", relativePath)
+			return false, nil
+		}
+
+		if known && unchanged {
+			s.LocalLogger.Debugf("deleted while not running (%s)", relativePath)
+			return true, s.applyLocalDeletion(ctx, local.File{Path: path.Join(s.LocalBasePath, relativePath), RelativePath: relativePath})
+		}
+
+		if !s.Mode.downloads() {
+			return false, nil
+		}
+
+		return false, s.applyDropboxCreation(ctx, remote)
+	case localExists:
+		if !known && !s.Mode.uploads() {
+			return false, nil
+		}
+
+		if !known {
+			return false, s.applyLocalCreation(ctx, localFile)
+		}
+
+		if s.Mode == ModeBackup {
+			s.DropboxLogger.Debugf("deleted from Dropbox while not running. upload it again (%s)", relativePath)
+
+			err := s.State.Delete(relativePath)
+			if err != nil {
+				return false, err
+			}
+
+			return false, s.applyLocalTreeCreation(ctx, localFile)
+		}
+
+		if localFile.Type == local.FileTypeFolder && !s.localTreeUnchanged(tree, relativePath) {
+			s.DropboxLogger.Debugf("deleted while not running but changed locally. reconcile its content (%s)", relativePath)
+			return false, nil
+		}
+
+		s.DropboxLogger.Debugf("deleted while not running (%s)", relativePath)
+		err := s.applyDropboxDeletion(ctx, dropbox.File{RelativePath: relativePath})
+		if err != nil {
+			return false, err
+		}
+
+		_, err = os.Stat(localFile.Path)
+		if os.IsNotExist(err) {
+			return true, nil
+		}
+
+		return false, s.applyLocalCreation(ctx, localFile)
+	default:
+		return true, s.State.Delete(relativePath)
+	}
+}
+
+// remoteFiles returns every file of the Dropbox folder. When the listing of the
+// last run can be resumed, they are the files recorded in the state updated with
+// the changes done since, instead of a listing of the whole folder
+func (s *Sync) remoteFiles(ctx context.Context) ([]dropbox.File, error) {
+	changes, resumed, err := s.DropboxScanner.ResumeListing(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	if !resumed {
+		s.DropboxLogger.Infof("list the whole Dropbox folder")
+		return s.DropboxScanner.InitialListing(ctx)
+	}
+
+	s.DropboxLogger.Infof("resume Dropbox listing with %d changes", len(changes))
+
+	remotes := make(map[string]dropbox.File)
+	for _, relativePath := range s.State.Paths() {
+		if entry, ok := s.State.Get(relativePath); ok && relativePath != "" {
+			remotes[relativePath] = s.remoteFromEntry(relativePath, entry)
+		}
+	}
+
+	for _, action := range changes {
+		switch action.Type {
+		case dropbox.ActionTypeCreate:
+			remotes[action.File.RelativePath] = action.File
+		case dropbox.ActionTypeDelete:
+			deleteTree(remotes, action.File.RelativePath)
+		case dropbox.ActionTypeMove:
+			deleteTree(remotes, action.Source.RelativePath)
+			remotes[action.File.RelativePath] = action.File
+		}
+	}
+
+	files := make([]dropbox.File, 0, len(remotes))
+	for _, file := range remotes {
+		files = append(files, file)
+	}
+	s.DropboxScanner.Remember(files)
+
+	return files, nil
+}
+
+// remoteFromEntry returns the Dropbox file as it was the last time both sides agreed on it
+func (s *Sync) remoteFromEntry(relativePath string, entry state.Entry) dropbox.File {
+	file := dropbox.File{
+		ID:           entry.ID,
+		ContentHash:  entry.ContentHash,
+		Name:         path.Base(relativePath),
+		RelativePath: relativePath,
+		RemotePath:   path.Join(s.RemoteBasePath, relativePath),
+		Rev:          entry.Rev,
+		Size:         entry.Size,
+		Type:         dropbox.FileTypeFile,
+	}
+
+	if entry.Folder {
+		file.Type = dropbox.FileTypeFolder
+	}
+
+	return file
+}
+
+// unchangedSince reports whether neither side changed since the last synchronization,
+// without hashing the local file
+func unchangedSince(base state.Entry, remote dropbox.File, localFile local.File) bool {
+	if base.Folder {
+		return remote.Type == dropbox.FileTypeFolder && localFile.Type == local.FileTypeFolder
+	}
+
+	if remote.Type != dropbox.FileTypeFile || remote.Rev != base.Rev || remote.ContentHash != base.ContentHash {
+		return false
+	}
+
+	info, err := os.Stat(localFile.Path)
+
+	return err == nil && !info.IsDir() && info.Size() == base.Size && info.ModTime().Equal(base.ModTime)
+}
+
+// remoteUnchangedSince reports whether a Dropbox path didn't change since the last synchronization
+func remoteUnchangedSince(base state.Entry, remote dropbox.File) bool {
+	if base.Folder {
+		return remote.Type == dropbox.FileTypeFolder
+	}
+
+	return remote.Type == dropbox.FileTypeFile && base.ContentHash == remote.ContentHash
+}
+
+// remoteTreeUnchanged reports whether every Dropbox path below a folder didn't
+// change since the last synchronization
+func (s *Sync) remoteTreeUnchanged(tree *reconciledTree, folder string) bool {
+	for relativePath, remote := range tree.remotes {
+		if !strings.HasPrefix(relativePath, folder+"/") {
+			continue
+		}
+
+		base, known := s.State.Get(relativePath)
+		if !known || !remoteUnchangedSince(base, remote) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// localTreeUnchanged reports whether every local path below a folder didn't
+// change since the last synchronization
+func (s *Sync) localTreeUnchanged(tree *reconciledTree, folder string) bool {
+	for relativePath, localFile := range tree.locals {
+		if strings.HasPrefix(relativePath, folder+"/") && !s.localUnchangedSince(localFile) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// localUnchangedSince reports whether a local path didn't change since the last
+// synchronization. Files are hashed only when their size or modification time changed
+func (s *Sync) localUnchangedSince(localFile local.File) bool {
+	base, known := s.State.Get(localFile.RelativePath)
+	if !known || base.Folder != (localFile.Type == local.FileTypeFolder) {
+		return false
+	}
+
+	if base.Folder || localFile.Size == base.Size && localFile.ModTime.Equal(base.ModTime) {
+		return true
+	}
+
+	localSum, err := s.localHash(localFile.Path)
+
+	return err == nil && localSum == base.ContentHash
+}
+
+func deleteTree(files map[string]dropbox.File, relativePath string) {
+	for candidate := range files {
+		if candidate == relativePath || strings.HasPrefix(candidate, relativePath+"/") {
+			delete(files, candidate)
+		}
+	}
+}
+
+// isIgnored reports whether a path matches the ignore rules, using its type on
+// either side. A path present on neither side is ignored when it would be either
+// as a file or as a folder
+func (s *Sync) isIgnored(relativePath string, remote dropbox.File, remoteExists bool, localFile local.File, localExists bool) bool {
+	if !remoteExists && !localExists {
+		return s.Ignore.MatchAny(relativePath)
+	}
+
+	folder := remoteExists && remote.Type == dropbox.FileTypeFolder || localExists && localFile.Type == local.FileTypeFolder
+
+	return s.Ignore.Match(relativePath, folder)
+}
+
+// reconciledPaths returns every path known remotely, locally or in the state, parents first
+func (s *Sync) reconciledPaths(tree *reconciledTree) []string {
+	unique := make(map[string]bool)
+	for relativePath := range tree.remotes {
+		unique[relativePath] = true
+	}
+
+	for relativePath := range tree.locals {
+		unique[relativePath] = true
+	}
+
+	for _, relativePath := range s.State.Paths() {
+		if relativePath != "" {
+			unique[relativePath] = true
+		}
+	}
+
+	paths := make([]string, 0, len(unique))
+	for relativePath := range unique {
+		paths = append(paths, relativePath)
+	}
+
+	sort.Strings(paths)
+
+	return paths
+}
+
+func isBelowAny(relativePath string, folders []string) bool {
+	for _, folder := range folders {
+		if strings.HasPrefix(relativePath, folder+"/") {
+			return true
+		}
+	}
+
+	return false
+}
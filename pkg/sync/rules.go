@@ -0,0 +1,20 @@
+package sync
+
+// applyIgnoreRules drops the position in the Dropbox changes when the ignore
+// rules changed since the last synchronization. The changes of ignored paths are
+// skipped, so the whole folder is listed again to find the paths no longer ignored
+func (s *Sync) applyIgnoreRules() error {
+	rules := s.Ignore.Fingerprint()
+	if s.State.IgnoreRules() == rules {
+		return nil
+	}
+
+	s.DropboxLogger.Infof("ignore rules changed. list the whole Dropbox folder")
+
+	err := s.State.SetCursor("")
+	if err != nil {
+		return err
+	}
+
+	return s.State.SetIgnoreRules(rules)
+}
@@ -0,0 +1,271 @@
+package sync
+
+import (
+	"context"
+	"path"
+	"strings"
+	gosync "sync"
+	"sync/atomic"
+
+	"github.com/kdisneur/dropbox_sync/pkg/dropbox"
+	"github.com/kdisneur/dropbox_sync/pkg/ignore"
+)
+
+// maxScheduled is the number of operations waiting or running at once. Scanning
+// waits beyond it so a huge change set isn't held in memory
+const maxScheduled = 1000
+
+// Transfers represents how many uploads and downloads of a folder run at the same time
+type Transfers struct {
+	Uploads   int
+	Downloads int
+}
+
+// DefaultTransfers runs 4 uploads and 4 downloads at the same time
+var DefaultTransfers = Transfers{
+	Uploads:   4,
+	Downloads: 4,
+}
+
+// transferKind tells which pool of workers runs an operation
+type transferKind int
+
+const (
+	transferUpload transferKind = iota
+	transferDownload
+)
+
+// scheduler runs the operations of a folder concurrently. An operation waits for
+// the ones scheduled before it on the same path, on one of its parents or on one
+// of its children, so a path changes in order and a folder is created before its
+// content
+type scheduler struct {
+	downloads chan struct{}
+	mutex     gosync.Mutex
+	pending   []*operation
+	queue     chan struct{}
+	uploads   chan struct{}
+}
+
+// operation represents a change of some paths, scheduled but not done yet
+type operation struct {
+	done  chan struct{}
+	paths []string
+}
+
+// operationGroup represents the operations scheduled by the same caller. Its first
+// failure stops its operations not started yet, without affecting other groups
+type operationGroup struct {
+	err     error
+	mutex   gosync.Mutex
+	running gosync.WaitGroup
+}
+
+func newScheduler(transfers Transfers) *scheduler {
+	return &scheduler{
+		downloads: make(chan struct{}, atLeastOne(transfers.Downloads)),
+		queue:     make(chan struct{}, maxScheduled),
+		uploads:   make(chan struct{}, atLeastOne(transfers.Uploads)),
+	}
+}
+
+func newOperationGroup() *operationGroup {
+	return &operationGroup{}
+}
+
+// schedule runs a function of a group in the background once the operations
+// scheduled before on related paths are done. It returns the first failure of
+// the group
+func (s *scheduler) schedule(ctx context.Context, group *operationGroup, kind transferKind, paths []string, run func() error) error {
+	err := group.Err()
+	if err != nil {
+		return err
+	}
+
+	select {
+	case s.queue <- struct{}{}:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	current := &operation{done: make(chan struct{})}
+	for _, relativePath := range paths {
+		current.paths = append(current.paths, strings.ToLower(relativePath))
+	}
+
+	var previous []*operation
+
+	s.mutex.Lock()
+	for _, candidate := range s.pending {
+		if candidate.overlaps(current) {
+			previous = append(previous, candidate)
+		}
+	}
+	s.pending = append(s.pending, current)
+	s.mutex.Unlock()
+
+	workers := s.uploads
+	if kind == transferDownload {
+		workers = s.downloads
+	}
+
+	group.running.Add(1)
+	go s.run(ctx, group, current, previous, workers, run)
+
+	return nil
+}
+
+func (s *scheduler) run(ctx context.Context, group *operationGroup, current *operation, previous []*operation, workers chan struct{}, run func() error) {
+	defer group.running.Done()
+	defer s.finish(current)
+
+	for _, candidate := range previous {
+		select {
+		case <-candidate.done:
+		case <-ctx.Done():
+			group.fail(ctx.Err())
+			return
+		}
+	}
+
+	select {
+	case workers <- struct{}{}:
+	case <-ctx.Done():
+		group.fail(ctx.Err())
+		return
+	}
+	defer func() { <-workers }()
+
+	if group.Err() != nil {
+		return
+	}
+
+	err := run()
+	if err != nil {
+		group.fail(err)
+	}
+}
+
+func (s *scheduler) finish(current *operation) {
+	s.mutex.Lock()
+	for i, candidate := range s.pending {
+		if candidate == current {
+			s.pending = append(s.pending[:i], s.pending[i+1:]...)
+			break
+		}
+	}
+	s.mutex.Unlock()
+
+	close(current.done)
+	<-s.queue
+}
+
+func (g *operationGroup) fail(err error) {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+
+	if g.err == nil {
+		g.err = err
+	}
+}
+
+// wait blocks until the operations of the group are done and returns its first failure
+func (g *operationGroup) wait() error {
+	g.running.Wait()
+
+	return g.Err()
+}
+
+// Err returns the first failure of the group if one exists
+func (g *operationGroup) Err() error {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+
+	return g.err
+}
+
+// drain waits for the operations of a group, so none of them is still running
+// once the caller returns, and reports their failure unless the caller already
+// returns an error
+func drain(group *operationGroup, err *error) {
+	waitErr := group.wait()
+	if *err == nil {
+		*err = waitErr
+	}
+}
+
+// overlaps reports whether two operations change the same path, or a path and
+// one of its children
+func (o *operation) overlaps(other *operation) bool {
+	for _, first := range o.paths {
+		for _, second := range other.paths {
+			if first == second || isBelow(first, second) || isBelow(second, first) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// isBelow reports whether a path is a child of a folder. Every path is below the root
+func isBelow(relativePath string, folder string) bool {
+	return folder == "" || strings.HasPrefix(relativePath, folder+"/")
+}
+
+func atLeastOne(count int) int {
+	if count < 1 {
+		return 1
+	}
+
+	return count
+}
+
+// operations returns the scheduler of the folder, created on first use with the
+// configured transfers
+func (s *Sync) operations() *scheduler {
+	s.schedulerOnce.Do(func() {
+		s.scheduler = newScheduler(s.Transfers)
+	})
+
+	return s.scheduler
+}
+
+// schedulingPaths returns the paths an operation is ordered on. An ignore file
+// changes the rules of its whole folder so it is ordered with everything in it
+func schedulingPaths(relativePaths ...string) []string {
+	paths := make([]string, 0, len(relativePaths))
+	for _, relativePath := range relativePaths {
+		if ignore.IsIgnoreFile(relativePath) {
+			relativePath = path.Dir(relativePath)
+			if relativePath == "/" {
+				relativePath = ""
+			}
+		}
+		paths = append(paths, relativePath)
+	}
+
+	return paths
+}
+
+// scheduledCursors saves the Dropbox cursor only once the Dropbox changes
+// scheduled before it have been applied, so a restart never skips them. No
+// cursor is saved after paths failed to reconcile, so the next run lists the
+// whole folder again
+type scheduledCursors struct {
+	dropbox.CursorStore
+	sync *Sync
+}
+
+func (c scheduledCursors) SetCursor(cursor string) error {
+	err := c.sync.dropboxOperations.wait()
+	if err != nil {
+		return err
+	}
+
+	if cursor != "" && atomic.LoadInt32(&c.sync.unreconciled) == 1 {
+		return nil
+	}
+
+	return c.CursorStore.SetCursor(cursor)
+}
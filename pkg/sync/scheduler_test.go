@@ -0,0 +1,195 @@
+package sync
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	gosync "sync"
+	"testing"
+	"time"
+)
+
+func TestScheduleSamePathInOrder(t *testing.T) {
+	s := newScheduler(Transfers{Uploads: 4, Downloads: 4})
+	group := newOperationGroup()
+
+	var mutex gosync.Mutex
+	var order []int
+
+	for i := 0; i < 20; i++ {
+		i := i
+
+		// paths are case insensitive, and uploads and downloads are ordered together
+		kind, relativePath := transferUpload, "/file.txt"
+		if i%2 == 0 {
+			kind, relativePath = transferDownload, "/File.txt"
+		}
+
+		err := s.schedule(context.Background(), group, kind, []string{relativePath}, func() error {
+			// the later operations would finish first if they didn't wait
+			time.Sleep(time.Duration(20-i) * time.Millisecond)
+
+			mutex.Lock()
+			order = append(order, i)
+			mutex.Unlock()
+
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	err := group.wait()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i, value := range order {
+		if value != i || len(order) != 20 {
+			t.Fatalf("expected the operations to run in order, got %v", order)
+		}
+	}
+}
+
+func TestScheduleChildAfterParent(t *testing.T) {
+	s := newScheduler(Transfers{Uploads: 4, Downloads: 4})
+	group := newOperationGroup()
+
+	var mutex gosync.Mutex
+	var order []string
+
+	record := func(step string, delay time.Duration) func() error {
+		return func() error {
+			time.Sleep(delay)
+
+			mutex.Lock()
+			order = append(order, step)
+			mutex.Unlock()
+
+			return nil
+		}
+	}
+
+	operations := []struct {
+		paths []string
+		run   func() error
+	}{
+		{[]string{"/folder"}, record("create folder", 50*time.Millisecond)},
+		{[]string{"/folder/file.txt"}, record("create file", 0)},
+		{[]string{"/other"}, record("create other", 0)},
+		{[]string{"/folder/file.txt", "/moved.txt"}, record("move file", 0)},
+		{[]string{""}, record("reload root rules", 0)},
+	}
+
+	for _, operation := range operations {
+		err := s.schedule(context.Background(), group, transferUpload, operation.paths, operation.run)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	err := group.wait()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []string{"create other", "create folder", "create file", "move file", "reload root rules"}
+	if !reflect.DeepEqual(order, expected) {
+		t.Fatalf("expected %v, got %v", expected, order)
+	}
+}
+
+func TestScheduleGroupFailure(t *testing.T) {
+	s := newScheduler(Transfers{Uploads: 1, Downloads: 1})
+	failing := newOperationGroup()
+	other := newOperationGroup()
+
+	failure := errors.New("failure")
+	release := make(chan struct{})
+
+	err := s.schedule(context.Background(), failing, transferUpload, []string{"/a"}, func() error {
+		<-release
+		return failure
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	skipped := true
+	err = s.schedule(context.Background(), failing, transferUpload, []string{"/b"}, func() error {
+		skipped = false
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var done []string
+	for _, relativePath := range []string{"/a", "/c"} {
+		relativePath := relativePath
+		err = s.schedule(context.Background(), other, transferDownload, []string{relativePath}, func() error {
+			done = append(done, relativePath)
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	close(release)
+
+	if err := failing.wait(); err != failure {
+		t.Fatalf("expected the group to fail with its first failure, got %v", err)
+	}
+
+	if !skipped {
+		t.Fatalf("expected the operations of a failed group not to start")
+	}
+
+	err = s.schedule(context.Background(), failing, transferUpload, []string{"/d"}, func() error { return nil })
+	if err != failure {
+		t.Fatalf("expected scheduling in a failed group to fail, got %v", err)
+	}
+
+	if err := other.wait(); err != nil || len(done) != 2 {
+		t.Fatalf("expected the other group to run its operations, got %v (%v)", done, err)
+	}
+}
+
+func TestScheduleLimit(t *testing.T) {
+	s := newScheduler(Transfers{Uploads: 1, Downloads: 1})
+	group := newOperationGroup()
+	release := make(chan struct{})
+
+	for i := 0; i < maxScheduled; i++ {
+		err := s.schedule(context.Background(), group, transferUpload, []string{fmt.Sprintf("/%d", i)}, func() error {
+			<-release
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	err := s.schedule(ctx, group, transferUpload, []string{"/beyond"}, func() error { return nil })
+	if err != context.DeadlineExceeded {
+		t.Fatalf("expected scheduling beyond the limit to wait, got %v", err)
+	}
+
+	close(release)
+
+	err = s.schedule(context.Background(), group, transferUpload, []string{"/beyond"}, func() error { return nil })
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = group.wait()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,79 @@
+package sync
+
+import (
+	"os"
+	"path"
+	"sort"
+)
+
+// applySelection removes the local copies of the paths left out of the selective
+// sync since the last run. When the selection changed, the position in the Dropbox
+// changes is dropped so the whole folder is listed again and the paths newly
+// selected are downloaded
+func (s *Sync) applySelection() error {
+	selection := s.Ignore.Selection().String()
+	if s.State.Selection() == selection {
+		return nil
+	}
+
+	s.DropboxLogger.Infof("selective sync changed. synchronize the new selection")
+
+	paths := s.State.Paths()
+	sort.Sort(sort.Reverse(sort.StringSlice(paths)))
+	for _, relativePath := range paths {
+		if relativePath == "" || s.Ignore.Selected(relativePath) {
+			continue
+		}
+
+		err := s.removeUnselected(relativePath)
+		if err != nil {
+			return err
+		}
+
+		err = s.State.Delete(relativePath)
+		if err != nil {
+			return err
+		}
+	}
+
+	err := s.State.SetCursor("")
+	if err != nil {
+		return err
+	}
+
+	return s.State.SetSelection(selection)
+}
+
+// removeUnselected removes the local copy of a path left out of the selective
+// sync. Files changed since the last synchronization and folders which aren't
+// empty are kept, so nothing is lost
+func (s *Sync) removeUnselected(relativePath string) error {
+	entry, _ := s.State.Get(relativePath)
+	filePath := path.Join(s.LocalBasePath, relativePath)
+
+	info, err := os.Lstat(filePath)
+	if os.IsNotExist(err) {
+		return nil
+	}
+
+	if err != nil {
+		return err
+	}
+
+	if info.IsDir() {
+		if os.Remove(filePath) != nil {
+			s.LocalLogger.Warnf("unselected folder isn't empty. keep it (%s)", relativePath)
+		}
+
+		return nil
+	}
+
+	if entry.Folder || info.Size() != entry.Size || !info.ModTime().Equal(entry.ModTime) {
+		s.LocalLogger.Warnf("unselected file changed since the last synchronization. keep it (%s)", relativePath)
+		return nil
+	}
+
+	s.LocalLogger.Debugf("unselected. remove local copy (%s)", relativePath)
+
+	return os.Remove(filePath)
+}
@@ -1,172 +1,633 @@
 package sync
 
 import (
+	"context"
 	"fmt"
-	"io/ioutil"
 	"os"
 	"path"
+	"strings"
+	gosync "sync"
 
 	"github.com/kdisneur/dropbox_sync/pkg/dropbox"
+	"github.com/kdisneur/dropbox_sync/pkg/ignore"
 	"github.com/kdisneur/dropbox_sync/pkg/local"
+	"github.com/kdisneur/dropbox_sync/pkg/state"
 	"github.com/sirupsen/logrus"
 )
 
+// Sync represents a synchronization between a Dropbox folder and a local folder,
+// in both directions or in one of them depending on its mode
 type Sync struct {
 	Client         *dropbox.Client
+	DeletionLimit  DeletionLimit
 	DropboxLogger  *logrus.Entry
 	DropboxScanner *dropbox.Scanner
+	Hashes         *local.HashCache
+	Ignore         *ignore.Matcher
 	LocalScanner   *local.Scanner
 	LocalBasePath  string
 	LocalLogger    *logrus.Entry
+	Mode           Mode
+	// PauseFolder holds the pause files of the directions which deleted too many
+	// files. Deletions are never paused when it is empty
+	PauseFolder    string
 	RemoteBasePath string
+	State          *state.Store
+	// Transfers is read when the first operation is scheduled
+	Transfers         Transfers
+	Trash             *local.Trash
+	conflicts         int64
+	dropboxDeletions  *deletionGuard
+	dropboxEchoes     *echoTracker
+	dropboxOperations *operationGroup
+	hostname          string
+	localDeletions    *deletionGuard
+	localEchoes       *echoTracker
+	localOperations   *operationGroup
+	reconcileRequests chan struct{}
+	scheduler         *scheduler
+	schedulerOnce     gosync.Once
+	// unreconciled is 1 when paths failed to reconcile, until a later reconcile succeeds
+	unreconciled int32
 }
 
-// NewSync creates a new bidirectional synchronizer between dropbox and the local filesystem
-func NewSync(client *dropbox.Client, localPath string, remotePath string) *Sync {
+// NewSync creates a new synchronizer between dropbox and the local filesystem.
+// Paths matched by the ignore rules are never synchronized
+func NewSync(client *dropbox.Client, store *state.Store, matcher *ignore.Matcher, mode Mode, localPath string, remotePath string) *Sync {
 	dropboxLogger := logrus.WithFields(
-		logrus.Fields{"folder": remotePath, "direction": "dropbox-to-local"},
+		logrus.Fields{"folder": remotePath, "direction": DirectionDropboxToLocal},
 	)
 
 	localLogger := logrus.WithFields(
-		logrus.Fields{"folder": localPath, "direction": "local-to-dropbox"},
+		logrus.Fields{"folder": localPath, "direction": DirectionLocalToDropbox},
 	)
 
-	return &Sync{
-		Client:         client,
-		LocalBasePath:  localPath,
-		RemoteBasePath: remotePath,
-		DropboxScanner: dropbox.NewScanner(dropboxLogger, *client, remotePath),
-		DropboxLogger:  dropboxLogger,
-		LocalScanner:   local.NewScanner(localLogger, localPath),
-		LocalLogger:    localLogger,
+	hostname, err := os.Hostname()
+	if err != nil {
+		hostname = "unknown"
+	}
+
+	s := &Sync{
+		Client:            client,
+		DeletionLimit:     DefaultDeletionLimit,
+		LocalBasePath:     localPath,
+		RemoteBasePath:    remotePath,
+		DropboxLogger:     dropboxLogger,
+		Ignore:            matcher,
+		LocalScanner:      local.NewScanner(localLogger, localPath, matcher),
+		LocalLogger:       localLogger,
+		Mode:              mode,
+		State:             store,
+		Transfers:         DefaultTransfers,
+		Trash:             local.NewTrash(localPath),
+		dropboxDeletions:  newDeletionGuard(dropboxLogger, DirectionDropboxToLocal),
+		dropboxEchoes:     newEchoTracker(dropboxEchoTTL),
+		dropboxOperations: newOperationGroup(),
+		hostname:          hostname,
+		localDeletions:    newDeletionGuard(localLogger, DirectionLocalToDropbox),
+		localEchoes:       newEchoTracker(localEchoTTL),
+		localOperations:   newOperationGroup(),
+		reconcileRequests: make(chan struct{}, 1),
+	}
+	s.DropboxScanner = dropbox.NewScanner(dropboxLogger, *client, remotePath, scheduledCursors{store, s}, matcher)
+
+	return s
+}
+
+// UseHashCache records the hashes of the downloaded files and keeps them across
+// local removals and renames
+func (s *Sync) UseHashCache(hashes *local.HashCache) {
+	s.Hashes = hashes
+	s.LocalScanner.UseHashCache(hashes)
+}
+
+// localHash computes the Dropbox content hash of a local file, using the hash
+// cache when there is one. A nil *local.HashCache would make a non-nil
+// dropbox.HashCache, so no cache is passed instead
+func (s *Sync) localHash(filePath string) (string, error) {
+	var cache dropbox.HashCache
+	if s.Hashes != nil {
+		cache = s.Hashes
 	}
+
+	return dropbox.HashFromFile(filePath, cache)
 }
 
-// DropboxFolder copies dropbox files to a local folder
-func (s *Sync) DropboxFolder() error {
-	for s.DropboxScanner.Next() {
-		action := s.DropboxScanner.Entry()
+// Close stops watching the local folder
+func (s *Sync) Close() error {
+	return s.LocalScanner.Close()
+}
+
+// DropboxFolder copies dropbox files to a local folder. The whole folder is
+// reconciled again when Dropbox resets the listing cursor, when the ignore rules
+// change or when local changes have been lost. Dropbox changes are not followed
+// in backup mode, where it only waits for a reconcile to be needed
+func (s *Sync) DropboxFolder(ctx context.Context) error {
+	if s.Mode == ModeBackup {
+		s.DropboxLogger.Infof("backup mode. Dropbox changes are not followed")
+	}
+
+	for {
+		followCtx, stopFollowing := context.WithCancel(ctx)
+		reconcileNeeded := s.watchReconcile(followCtx, stopFollowing)
 
 		var err error
-		switch action.Type {
-		case dropbox.ActionTypeCreate:
-			s.DropboxLogger.Debugf("creates or update file or folder '%s'", action.File.RelativePath)
-			err = s.createLocalFileOrFolder(action.File)
-			s.LocalScanner.NotifyCreation(action.File.RelativePath)
-		case dropbox.ActionTypeDelete:
-			s.DropboxLogger.Debugf("delete file or folder '%s'", action.File.RelativePath)
-			err = s.deleteLocalFileOrFolder(action.File)
-			s.LocalScanner.NotifyDeletion(action.File.RelativePath)
+		if s.Mode == ModeBackup {
+			<-followCtx.Done()
+		} else {
+			err = s.followDropboxChanges(followCtx)
+		}
+		stopFollowing()
+		needed := <-reconcileNeeded
+
+		switch {
+		case ctx.Err() != nil:
+			return ctx.Err()
+		case needed:
+		case dropbox.IsReset(err):
+			s.DropboxLogger.Warnf("Dropbox cursor has been reset. reconcile the whole folder")
 		default:
-			err = fmt.Errorf("unsupported dropbox action: %s", action.Type)
+			return err
 		}
 
+		err = s.Reconcile(ctx)
 		if err != nil {
 			return err
 		}
 	}
-
-	if s.DropboxScanner.Err() != nil {
-		return s.DropboxScanner.Err()
-	}
-
-	return nil
 }
 
-// LocalFolder copies dropbox files to a local folder
-func (s *Sync) LocalFolder() error {
-	for s.LocalScanner.Next() {
-		action := s.LocalScanner.Entry()
+func (s *Sync) followDropboxChanges(ctx context.Context) (err error) {
+	// a new group each time, so a previous stop doesn't prevent following again
+	s.dropboxOperations = newOperationGroup()
+	defer drain(s.dropboxOperations, &err)
 
-		var err error
-		switch action.Type {
-		case local.ActionTypeCreate:
-			s.LocalLogger.Debugf("creates or update file or folder '%s'", action.File.RelativePath)
-			err = s.createDropboxFileOrFolder(action.File)
-		case local.ActionTypeDelete:
-			s.LocalLogger.Debugf("delete file or folder '%s'", action.File.RelativePath)
-			err = dropbox.FileDelete(*s.Client, path.Join(s.RemoteBasePath, action.File.RelativePath))
-		default:
-			err = fmt.Errorf("unsupported local action: %s", action.Type)
+	for s.DropboxScanner.Next(ctx) {
+		action := *s.DropboxScanner.Entry()
+
+		paths := schedulingPaths(action.File.RelativePath)
+		if action.Type == dropbox.ActionTypeMove {
+			paths = schedulingPaths(action.Source.RelativePath, action.File.RelativePath)
 		}
 
+		err := s.operations().schedule(ctx, s.dropboxOperations, transferDownload, paths, func() error {
+			return s.applyDropboxAction(ctx, &action)
+		})
 		if err != nil {
 			return err
 		}
 	}
 
-	if s.LocalScanner.Err() != nil {
-		return s.LocalScanner.Err()
+	return s.DropboxScanner.Err()
+}
+
+// applyDropboxAction propagates a single Dropbox change
+func (s *Sync) applyDropboxAction(ctx context.Context, action *dropbox.Action) error {
+	if s.isDropboxEcho(action) {
+		s.DropboxLogger.Debugf("change done by the synchronizer. skip (%s)", action.File.RelativePath)
+		return nil
 	}
 
-	return nil
+	var err error
+	switch {
+	case s.Mode == ModeMirrorLocal:
+		err = s.revertDropboxAction(ctx, action)
+	case action.Type == dropbox.ActionTypeCreate:
+		s.DropboxLogger.Debugf("creates or update file or folder '%s'", action.File.RelativePath)
+		err = s.applyDropboxCreation(ctx, action.File)
+		s.LocalScanner.NotifyCreation(action.File.RelativePath)
+	case action.Type == dropbox.ActionTypeDelete:
+		s.DropboxLogger.Debugf("delete file or folder '%s'", action.File.RelativePath)
+		err = s.applyDropboxDeletion(ctx, action.File)
+		s.LocalScanner.NotifyDeletion(action.File.RelativePath)
+	case action.Type == dropbox.ActionTypeMove:
+		s.DropboxLogger.Debugf("move file or folder '%s' to '%s'", action.Source.RelativePath, action.File.RelativePath)
+		err = s.applyDropboxMove(ctx, action.Source, action.File)
+	default:
+		err = fmt.Errorf("unsupported dropbox action: %s", action.Type)
+	}
+
+	return err
 }
 
-func (s *Sync) createDropboxFileOrFolder(file local.File) error {
-	switch file.Type {
-	case local.FileTypeFile:
-		content, err := ioutil.ReadFile(file.Path)
+// LocalFolder copies local files to a Dropbox folder. Local changes are dropped
+// in download mode
+func (s *Sync) LocalFolder(ctx context.Context) (err error) {
+	defer drain(s.localOperations, &err)
+
+	for s.LocalScanner.Next(ctx) {
+		action := *s.LocalScanner.Entry()
+
+		if action.Type == local.ActionTypeOverflow {
+			s.LocalLogger.Warnf("local changes lost. reconcile the whole folder")
+			s.requestReconcile()
+			continue
+		}
+
+		paths := schedulingPaths(action.File.RelativePath)
+		if action.Type == local.ActionTypeMove {
+			paths = schedulingPaths(action.Source.RelativePath, action.File.RelativePath)
+		}
+
+		err := s.operations().schedule(ctx, s.localOperations, transferUpload, paths, func() error {
+			return s.applyLocalAction(ctx, &action)
+		})
 		if err != nil {
 			return err
 		}
+	}
 
-		return dropbox.FileUpload(*s.Client, path.Join(s.RemoteBasePath, file.RelativePath), content)
-	case local.FileTypeFolder:
-		return dropbox.FolderCreate(*s.Client, path.Join(s.RemoteBasePath, file.RelativePath))
+	return s.LocalScanner.Err()
+}
+
+// applyLocalAction propagates a single local change
+func (s *Sync) applyLocalAction(ctx context.Context, action *local.Action) error {
+	if s.isLocalEcho(action) {
+		s.LocalLogger.Debugf("change done by the synchronizer. skip (%s)", action.File.RelativePath)
+		return nil
+	}
+
+	var err error
+	switch {
+	case s.Mode == ModeDownload:
+		s.LocalLogger.Debugf("download mode. skip local change (%s)", action.File.RelativePath)
+	case s.Mode == ModeMirrorDropbox:
+		err = s.revertLocalAction(ctx, action)
+	case action.Type == local.ActionTypeCreate:
+		s.LocalLogger.Debugf("creates or update file or folder '%s'", action.File.RelativePath)
+		err = s.applyLocalCreation(ctx, action.File)
+	case action.Type == local.ActionTypeDelete:
+		s.LocalLogger.Debugf("delete file or folder '%s'", action.File.RelativePath)
+		err = s.applyLocalDeletion(ctx, action.File)
+	case action.Type == local.ActionTypeMove:
+		s.LocalLogger.Debugf("move file or folder '%s' to '%s'", action.Source.RelativePath, action.File.RelativePath)
+		err = s.applyLocalMove(ctx, action.Source, action.File)
 	default:
-		return fmt.Errorf("unsupported local file type: %s", file.Type)
+		err = fmt.Errorf("unsupported local action: %s", action.Type)
 	}
+
+	return err
 }
 
-func (s *Sync) createLocalFileOrFolder(file dropbox.File) error {
+// applyDropboxCreation compares the Dropbox file with the local one and the last
+// synchronized version to decide whether the local copy has to be updated
+func (s *Sync) applyDropboxCreation(ctx context.Context, file dropbox.File) error {
 	filePath := path.Join(s.LocalBasePath, file.RelativePath)
 
-	currentSum, currentSumErr := dropbox.HashFromFile(filePath)
-	if currentSumErr == nil && currentSum == file.ContentHash {
-		s.DropboxLogger.Debugf("file already up-to-date. skip creation (%s)", filePath)
-		return nil
+	err := s.clearMirroredPath(filePath, file.Type == dropbox.FileTypeFolder)
+	if err != nil {
+		return err
 	}
 
 	switch file.Type {
 	case dropbox.FileTypeFolder:
-		return os.MkdirAll(filePath, 0750)
+		err := os.MkdirAll(filePath, 0750)
+		if err != nil {
+			return err
+		}
+		s.expectLocalWrite(file.RelativePath, filePath)
+
+		return s.State.Put(file.RelativePath, state.Entry{ID: file.ID, Folder: true})
 	case dropbox.FileTypeFile:
-		return s.fetchDropboxContent(file.RemotePath, filePath)
 	default:
 		return fmt.Errorf("unsupported dropbox file type: %s", file.Type)
 	}
+
+	base, known := s.State.Get(file.RelativePath)
+	if known && base.ContentHash == file.ContentHash && base.Rev == file.Rev {
+		s.DropboxLogger.Debugf("file already synchronized. skip creation (%s)", filePath)
+		return nil
+	}
+
+	localSum, localSumErr := s.localHash(filePath)
+	if localSumErr == nil && localSum == file.ContentHash {
+		s.DropboxLogger.Debugf("file already up-to-date. skip creation (%s)", filePath)
+		return s.recordDropboxFile(file, filePath)
+	}
+
+	if localSumErr == nil && (!known || localSum != base.ContentHash) && s.Mode != ModeMirrorDropbox {
+		return s.resolveConflict(ctx, file, file.RelativePath)
+	}
+
+	err = s.fetchDropboxContent(ctx, file.RemotePath, filePath)
+	if err != nil {
+		return err
+	}
+	s.expectLocalWrite(file.RelativePath, filePath)
+
+	if ignore.IsIgnoreFile(filePath) {
+		s.Ignore.Reload(path.Dir(file.RelativePath))
+	}
+
+	return s.recordDropboxFile(file, filePath)
 }
 
-func (s *Sync) deleteLocalFileOrFolder(file dropbox.File) error {
+// applyDropboxDeletion removes the local file unless it changed since the last
+// synchronization. The content of a folder changed since is kept
+func (s *Sync) applyDropboxDeletion(ctx context.Context, file dropbox.File) error {
 	filePath := path.Join(s.LocalBasePath, file.RelativePath)
 
-	return os.RemoveAll(filePath)
+	info, err := os.Stat(filePath)
+	if os.IsNotExist(err) {
+		return s.State.Delete(file.RelativePath)
+	}
+	folder := err == nil && info.IsDir()
+
+	if err == nil && !info.IsDir() {
+		base, known := s.State.Get(file.RelativePath)
+		localSum, localSumErr := s.localHash(filePath)
+		if localSumErr == nil && (!known || localSum != base.ContentHash) && s.Mode != ModeMirrorDropbox {
+			s.DropboxLogger.Warnf("file changed locally since last synchronization. skip deletion (%s)", filePath)
+			return s.State.Delete(file.RelativePath)
+		}
+	}
+
+	err = s.allowDeletion(ctx, s.dropboxDeletions, file.RelativePath)
+	if err != nil {
+		return err
+	}
+
+	if folder && s.Mode != ModeMirrorDropbox {
+		return s.removeLocalFolder(ctx, file.RelativePath)
+	}
+
+	return s.removeLocalPath(file.RelativePath)
 }
 
-func (s *Sync) fetchDropboxContent(dropboxPath string, localPath string) error {
-	content, err := dropbox.FileDownload(*s.Client, dropboxPath)
+// removeLocalTree moves to the trash a file, or a folder with everything it
+// contains except the ignored paths. Folders still holding ignored paths are kept
+func (s *Sync) removeLocalTree(filePath string) error {
+	info, err := os.Lstat(filePath)
+	if os.IsNotExist(err) {
+		return nil
+	}
+
 	if err != nil {
 		return err
 	}
 
-	err = writeLocalFileAndSubfolders(localPath, content)
+	batch := s.Trash.Batch()
+	if !info.IsDir() {
+		return batch.Put(filePath, relativePath(s.LocalBasePath, filePath))
+	}
+
+	files, err := local.WalkFrom(s.LocalBasePath, filePath, s.Ignore)
 	if err != nil {
 		return err
 	}
 
+	for i := len(files) - 1; i >= 0; i-- {
+		if files[i].Type == local.FileTypeFolder {
+			os.Remove(files[i].Path)
+			continue
+		}
+
+		err = batch.Put(files[i].Path, files[i].RelativePath)
+		if err != nil {
+			return err
+		}
+	}
+
+	err = os.Remove(filePath)
+	if err != nil && !os.IsNotExist(err) {
+		s.DropboxLogger.Debugf("folder still holds ignored files. keep it (%s)", filePath)
+	}
+
 	return nil
 }
 
-func writeLocalFileAndSubfolders(filePath string, content []byte) error {
-	err := os.MkdirAll(path.Dir(filePath), 0750)
+// applyLocalCreation compares the local file with the Dropbox one and the last
+// synchronized version to decide whether it has to be uploaded
+func (s *Sync) applyLocalCreation(ctx context.Context, file local.File) error {
+	remotePath := path.Join(s.RemoteBasePath, file.RelativePath)
+	base, known := s.State.Get(file.RelativePath)
+
+	switch file.Type {
+	case local.FileTypeFolder:
+		if known && base.Folder {
+			return nil
+		}
+
+		err := dropbox.FolderCreate(ctx, *s.Client, remotePath)
+		if err != nil {
+			remote, metadataErr := dropbox.FileMetadata(ctx, *s.Client, remotePath)
+			if metadataErr != nil {
+				return err
+			}
+
+			if remote.Type != dropbox.FileTypeFolder {
+				if s.Mode != ModeMirrorLocal {
+					return err
+				}
+
+				err = dropbox.FileDelete(ctx, *s.Client, remotePath)
+				if err != nil {
+					return err
+				}
+
+				err = dropbox.FolderCreate(ctx, *s.Client, remotePath)
+				if err != nil {
+					return err
+				}
+			}
+		}
+		s.dropboxEchoes.expect(file.RelativePath, echo{folder: true})
+
+		return s.State.Put(file.RelativePath, state.Entry{Folder: true})
+	case local.FileTypeFile:
+	default:
+		return fmt.Errorf("unsupported local file type: %s", file.Type)
+	}
+
+	localSum, err := s.localHash(file.Path)
+	if err != nil {
+		s.LocalLogger.Debugf("file disappeared. skip upload (%s)", file.Path)
+		return nil
+	}
+
+	if known && localSum == base.ContentHash {
+		s.LocalLogger.Debugf("file already synchronized. skip upload (%s)", file.Path)
+		return nil
+	}
+
+	mode := dropbox.WriteModeAdd
+	remote, err := dropbox.FileMetadata(ctx, *s.Client, remotePath)
+	if err != nil && !dropbox.IsNotFound(err) {
+		return err
+	}
+
+	if err == nil && remote.Type == dropbox.FileTypeFolder && s.Mode == ModeMirrorLocal {
+		err = dropbox.FileDelete(ctx, *s.Client, remotePath)
+		if err != nil {
+			return err
+		}
+		s.dropboxEchoes.expect(file.RelativePath, echo{deleted: true})
+		remote = nil
+	}
+
+	if remote != nil {
+		if remote.ContentHash == localSum {
+			s.LocalLogger.Debugf("file already up-to-date. skip upload (%s)", file.Path)
+			return s.recordDropboxFile(*remote, file.Path)
+		}
+
+		if (!known || remote.ContentHash != base.ContentHash) && s.Mode != ModeMirrorLocal {
+			return s.resolveConflict(ctx, *remote, file.RelativePath)
+		}
+
+		mode = dropbox.WriteModeUpdate(remote.Rev)
+	}
+
+	uploaded, err := s.uploadFile(ctx, file.Path, remotePath, mode)
+	if dropbox.IsConflict(err) {
+		remote, metadataErr := dropbox.FileMetadata(ctx, *s.Client, remotePath)
+		if metadataErr != nil {
+			return err
+		}
+
+		return s.resolveConflict(ctx, *remote, file.RelativePath)
+	}
+
+	if err != nil {
+		return err
+	}
+	s.dropboxEchoes.expect(file.RelativePath, echo{rev: uploaded.Rev})
+
+	return s.recordDropboxFile(*uploaded, file.Path)
+}
+
+// applyLocalDeletion removes the Dropbox file unless it changed since the last
+// synchronization. Dropbox files are never removed in backup mode, nor the
+// ignored or changed paths of a removed folder
+func (s *Sync) applyLocalDeletion(ctx context.Context, file local.File) error {
+	remotePath := path.Join(s.RemoteBasePath, file.RelativePath)
+
+	if _, err := os.Stat(file.Path); err == nil {
+		s.LocalLogger.Debugf("file exists again. skip deletion (%s)", file.Path)
+		return nil
+	}
+
+	base, known := s.State.Get(file.RelativePath)
+	if !known && s.Mode != ModeMirrorLocal {
+		s.LocalLogger.Debugf("file never synchronized. skip deletion (%s)", file.Path)
+		return nil
+	}
+
+	if s.Mode == ModeBackup {
+		s.LocalLogger.Debugf("backup mode. keep Dropbox file (%s)", file.Path)
+		return s.State.Delete(file.RelativePath)
+	}
+
+	if !base.Folder && s.Mode != ModeMirrorLocal {
+		remote, err := dropbox.FileMetadata(ctx, *s.Client, remotePath)
+		if dropbox.IsNotFound(err) {
+			return s.State.Delete(file.RelativePath)
+		}
+
+		if err != nil {
+			return err
+		}
+
+		if remote.ContentHash != base.ContentHash {
+			s.LocalLogger.Warnf("file changed on Dropbox since last synchronization. skip deletion (%s)", file.Path)
+			return s.State.Delete(file.RelativePath)
+		}
+	}
+
+	err := s.allowDeletion(ctx, s.localDeletions, file.RelativePath)
 	if err != nil {
 		return err
 	}
 
-	err = ioutil.WriteFile(filePath, content, 0640)
+	if base.Folder {
+		return s.deleteDropboxFolder(ctx, file.RelativePath)
+	}
+
+	return s.deleteDropboxPath(ctx, file.RelativePath)
+}
+
+func (s *Sync) recordDropboxFile(file dropbox.File, localPath string) error {
+	relativePath := relativePath(s.LocalBasePath, localPath)
+
+	info, err := os.Stat(localPath)
 	if err != nil {
 		return err
 	}
 
-	return nil
+	return s.State.Put(relativePath, state.Entry{
+		ID:          file.ID,
+		ContentHash: file.ContentHash,
+		ModTime:     info.ModTime(),
+		Rev:         file.Rev,
+		Size:        info.Size(),
+	})
+}
+
+func (s *Sync) uploadFile(ctx context.Context, localPath string, remotePath string, mode dropbox.WriteMode) (*dropbox.File, error) {
+	reader, err := os.Open(localPath)
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+
+	return dropbox.FileUploadStream(ctx, *s.Client, remotePath, reader, mode)
+}
+
+// fetchDropboxContent streams a Dropbox file into a temporary file which replaces
+// the local one only once its content has been verified and flushed to disk
+func (s *Sync) fetchDropboxContent(ctx context.Context, dropboxPath string, localPath string) error {
+	err := os.MkdirAll(path.Dir(localPath), 0750)
+	if err != nil {
+		return err
+	}
+
+	temporary, err := local.TempFile(localPath)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(temporary.Name())
+
+	downloaded, err := dropbox.FileDownloadTo(ctx, *s.Client, dropboxPath, temporary)
+	if err == nil {
+		err = temporary.Sync()
+	}
+
+	closeErr := temporary.Close()
+	if err != nil {
+		return err
+	}
+
+	if closeErr != nil {
+		return closeErr
+	}
+
+	err = os.Chmod(temporary.Name(), 0640)
+	if err != nil {
+		return err
+	}
+
+	if info, err := os.Lstat(localPath); err == nil && info.Mode().IsRegular() {
+		err = s.Trash.Batch().Keep(localPath, relativePath(s.LocalBasePath, localPath))
+		if err != nil {
+			return err
+		}
+	}
+
+	// the content has been checked against its hash, so it never has to be read again.
+	// A rename keeps the stats the cached hash is checked against
+	info, err := os.Stat(temporary.Name())
+	if err != nil {
+		return err
+	}
+
+	err = os.Rename(temporary.Name(), localPath)
+	if err != nil {
+		return err
+	}
+
+	return s.Hashes.Put(localPath, info, downloaded.ContentHash)
+}
+
+func relativePath(base string, path string) string {
+	return strings.TrimPrefix(path, base)
 }
@@ -0,0 +1,493 @@
+package sync_test
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/kdisneur/dropbox_sync/pkg/dropbox/dropboxtest"
+	"github.com/kdisneur/dropbox_sync/pkg/ignore"
+	"github.com/kdisneur/dropbox_sync/pkg/state"
+	"github.com/kdisneur/dropbox_sync/pkg/sync"
+	"github.com/sirupsen/logrus"
+)
+
+func TestRoundTrip(t *testing.T) {
+	logrus.SetOutput(ioutil.Discard)
+
+	srv := dropboxtest.NewServer()
+	defer srv.Close()
+
+	localPath, err := ioutil.TempDir("", "dropbox_sync")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(localPath)
+
+	store, err := state.Open(filepath.Join(localPath, ignore.ReservedFolder, "state.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	matcher, err := ignore.NewMatcher(localPath, nil, ignore.Selection{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	srv.WriteFile("/remote/from_dropbox.txt", []byte("dropbox"))
+	writeLocal(t, localPath, "from_local.txt", "local")
+
+	client := srv.Client()
+	synchronizer := sync.NewSync(&client, store, matcher, sync.ModeSync, localPath, "/remote")
+	defer synchronizer.Close()
+
+	err = synchronizer.Reconcile(context.Background())
+	if err != nil {
+		t.Fatalf("can't reconcile: %s", err)
+	}
+
+	expectRemote(t, srv, "/remote/from_local.txt", "local")
+	expectLocal(t, localPath, "from_dropbox.txt", "dropbox")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	stopped := make(chan error, 2)
+	go func() { stopped <- synchronizer.DropboxFolder(ctx) }()
+	go func() { stopped <- synchronizer.LocalFolder(ctx) }()
+
+	// upload
+	writeLocal(t, localPath, "uploaded.txt", "uploaded")
+	eventually(t, "upload", func() bool { return readRemote(srv, "/remote/uploaded.txt") == "uploaded" })
+
+	// download
+	srv.WriteFile("/remote/downloaded.txt", []byte("downloaded"))
+	eventually(t, "download", func() bool { return readLocal(localPath, "downloaded.txt") == "downloaded" })
+
+	// move
+	err = os.Rename(filepath.Join(localPath, "uploaded.txt"), filepath.Join(localPath, "moved.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	eventually(t, "local move", func() bool {
+		return readRemote(srv, "/remote/moved.txt") == "uploaded" && readRemote(srv, "/remote/uploaded.txt") == ""
+	})
+
+	srv.Move("/remote/downloaded.txt", "/remote/renamed.txt")
+	eventually(t, "Dropbox move", func() bool {
+		return readLocal(localPath, "renamed.txt") == "downloaded" && readLocal(localPath, "downloaded.txt") == ""
+	})
+
+	// delete
+	err = os.Remove(filepath.Join(localPath, "moved.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	eventually(t, "local deletion", func() bool { return readRemote(srv, "/remote/moved.txt") == "" })
+
+	srv.Remove("/remote/renamed.txt")
+	eventually(t, "Dropbox deletion", func() bool { return readLocal(localPath, "renamed.txt") == "" })
+
+	cancel()
+	<-stopped
+	<-stopped
+
+	// conflict
+	writeLocal(t, localPath, "from_dropbox.txt", "changed locally")
+	srv.WriteFile("/remote/from_dropbox.txt", []byte("changed on Dropbox"))
+
+	err = synchronizer.Reconcile(context.Background())
+	if err != nil {
+		t.Fatalf("can't reconcile: %s", err)
+	}
+
+	expectLocal(t, localPath, "from_dropbox.txt", "changed on Dropbox")
+	expectRemote(t, srv, "/remote/from_dropbox.txt", "changed on Dropbox")
+
+	if synchronizer.Conflicts() != 1 {
+		t.Fatalf("expected 1 conflict, got %d", synchronizer.Conflicts())
+	}
+
+	var copyName string
+	for _, remotePath := range srv.Paths() {
+		if strings.Contains(remotePath, "conflicted copy") {
+			copyName = filepath.Base(remotePath)
+		}
+	}
+
+	if copyName == "" {
+		t.Fatalf("expected a conflicted copy on Dropbox, got %v", srv.Paths())
+	}
+
+	expectLocal(t, localPath, copyName, "changed locally")
+	expectRemote(t, srv, "/remote/"+copyName, "changed locally")
+}
+
+func TestReconcileFailure(t *testing.T) {
+	logrus.SetOutput(ioutil.Discard)
+
+	srv := dropboxtest.NewServer()
+	defer srv.Close()
+
+	localPath, err := ioutil.TempDir("", "dropbox_sync")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(localPath)
+
+	store, err := state.Open(filepath.Join(localPath, ignore.ReservedFolder, "state.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	matcher, err := ignore.NewMatcher(localPath, nil, ignore.Selection{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client := srv.Client()
+	srv.WriteFile("/remote/file.txt", []byte("first"))
+
+	// first run, which saves a cursor once following Dropbox
+	synchronizer := sync.NewSync(&client, store, matcher, sync.ModeSync, localPath, "/remote")
+	follow(t, synchronizer, func() bool { return store.Cursor() != "" })
+	synchronizer.Close()
+	expectLocal(t, localPath, "file.txt", "first")
+
+	// second run, which can't download the change done while not running
+	srv.WriteFile("/remote/file.txt", []byte("second"))
+	srv.RestrictContent("/remote/file.txt")
+
+	synchronizer = sync.NewSync(&client, store, matcher, sync.ModeSync, localPath, "/remote")
+	follow(t, synchronizer, func() bool {
+		srv.WriteFile("/remote/other.txt", []byte("other"))
+		return readLocal(localPath, "other.txt") == "other"
+	})
+	synchronizer.Close()
+	expectLocal(t, localPath, "file.txt", "first")
+
+	if store.Cursor() != "" {
+		t.Fatalf("expected the cursor to be dropped after a path failed to reconcile")
+	}
+
+	// third run, which lists the whole folder again
+	srv.AllowContent("/remote/file.txt")
+
+	synchronizer = sync.NewSync(&client, store, matcher, sync.ModeSync, localPath, "/remote")
+	defer synchronizer.Close()
+
+	err = synchronizer.Reconcile(context.Background())
+	if err != nil {
+		t.Fatalf("can't reconcile: %s", err)
+	}
+
+	expectLocal(t, localPath, "file.txt", "second")
+}
+
+func TestIgnoredPathsKept(t *testing.T) {
+	logrus.SetOutput(ioutil.Discard)
+
+	srv := dropboxtest.NewServer()
+	defer srv.Close()
+
+	localPath, err := ioutil.TempDir("", "dropbox_sync")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(localPath)
+
+	store, err := state.Open(filepath.Join(localPath, ignore.ReservedFolder, "state.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	matcher, err := ignore.NewMatcher(localPath, []string{"*.log"}, ignore.Selection{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	srv.WriteFile("/remote/folder/synced.txt", []byte("synced"))
+	srv.WriteFile("/remote/folder/ignored.log", []byte("ignored"))
+
+	client := srv.Client()
+	synchronizer := sync.NewSync(&client, store, matcher, sync.ModeSync, localPath, "/remote")
+	defer synchronizer.Close()
+
+	err = synchronizer.Reconcile(context.Background())
+	if err != nil {
+		t.Fatalf("can't reconcile: %s", err)
+	}
+
+	expectLocal(t, localPath, "folder/synced.txt", "synced")
+	expectLocal(t, localPath, "folder/ignored.log", "")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	stopped := make(chan error, 1)
+	go func() { stopped <- synchronizer.LocalFolder(ctx) }()
+
+	// moved out, so the deletion of the folder is the only change
+	outside, err := ioutil.TempDir("", "dropbox_sync")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(outside)
+
+	err = os.Rename(filepath.Join(localPath, "folder"), filepath.Join(outside, "folder"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	eventually(t, "local deletion", func() bool { return readRemote(srv, "/remote/folder/synced.txt") == "" })
+
+	cancel()
+	<-stopped
+
+	expectRemote(t, srv, "/remote/folder/ignored.log", "ignored")
+}
+
+func TestFolderDeletionKeepsChanges(t *testing.T) {
+	logrus.SetOutput(ioutil.Discard)
+
+	srv := dropboxtest.NewServer()
+	defer srv.Close()
+
+	localPath, err := ioutil.TempDir("", "dropbox_sync")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(localPath)
+
+	store, err := state.Open(filepath.Join(localPath, ignore.ReservedFolder, "state.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	matcher, err := ignore.NewMatcher(localPath, nil, ignore.Selection{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	srv.WriteFile("/remote/deleted_locally/synced.txt", []byte("synced"))
+	srv.WriteFile("/remote/deleted_on_dropbox/synced.txt", []byte("synced"))
+
+	client := srv.Client()
+	synchronizer := sync.NewSync(&client, store, matcher, sync.ModeSync, localPath, "/remote")
+	defer synchronizer.Close()
+
+	err = synchronizer.Reconcile(context.Background())
+	if err != nil {
+		t.Fatalf("can't reconcile: %s", err)
+	}
+
+	// a change the synchronizer doesn't follow
+	srv.WriteFile("/remote/deleted_locally/added.txt", []byte("added on Dropbox"))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	stopped := make(chan error, 1)
+	go func() { stopped <- synchronizer.LocalFolder(ctx) }()
+
+	err = os.RemoveAll(filepath.Join(localPath, "deleted_locally"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	eventually(t, "local folder deletion", func() bool {
+		return readLocal(localPath, "deleted_locally/added.txt") == "added on Dropbox"
+	})
+
+	expectRemote(t, srv, "/remote/deleted_locally/synced.txt", "")
+	expectRemote(t, srv, "/remote/deleted_locally/added.txt", "added on Dropbox")
+
+	cancel()
+	<-stopped
+
+	// a change the synchronizer doesn't follow
+	writeLocal(t, localPath, "deleted_on_dropbox/added.txt", "added locally")
+
+	ctx, cancel = context.WithCancel(context.Background())
+	go func() { stopped <- synchronizer.DropboxFolder(ctx) }()
+
+	srv.Remove("/remote/deleted_on_dropbox")
+	eventually(t, "Dropbox folder deletion", func() bool {
+		return readRemote(srv, "/remote/deleted_on_dropbox/added.txt") == "added locally"
+	})
+
+	cancel()
+	<-stopped
+
+	expectLocal(t, localPath, "deleted_on_dropbox/synced.txt", "")
+	expectLocal(t, localPath, "deleted_on_dropbox/added.txt", "added locally")
+	expectRemote(t, srv, "/remote/deleted_on_dropbox/synced.txt", "")
+}
+
+func TestDeletedAgain(t *testing.T) {
+	logrus.SetOutput(ioutil.Discard)
+
+	srv := dropboxtest.NewServer()
+	defer srv.Close()
+
+	localPath, err := ioutil.TempDir("", "dropbox_sync")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(localPath)
+
+	store, err := state.Open(filepath.Join(localPath, ignore.ReservedFolder, "state.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	matcher, err := ignore.NewMatcher(localPath, nil, ignore.Selection{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	srv.WriteFile("/remote/file.txt", []byte("first"))
+
+	client := srv.Client()
+	synchronizer := sync.NewSync(&client, store, matcher, sync.ModeSync, localPath, "/remote")
+	defer synchronizer.Close()
+
+	err = synchronizer.Reconcile(context.Background())
+	if err != nil {
+		t.Fatalf("can't reconcile: %s", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	stopped := make(chan error, 2)
+	go func() { stopped <- synchronizer.DropboxFolder(ctx) }()
+	go func() { stopped <- synchronizer.LocalFolder(ctx) }()
+
+	srv.Remove("/remote/file.txt")
+	eventually(t, "Dropbox deletion", func() bool { return readLocal(localPath, "file.txt") == "" })
+
+	writeLocal(t, localPath, "file.txt", "second")
+	eventually(t, "upload", func() bool { return readRemote(srv, "/remote/file.txt") == "second" })
+
+	err = os.Remove(filepath.Join(localPath, "file.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	eventually(t, "local deletion", func() bool { return readRemote(srv, "/remote/file.txt") == "" })
+
+	cancel()
+	<-stopped
+	<-stopped
+}
+
+func TestBackupIgnoreRulesChange(t *testing.T) {
+	logrus.SetOutput(ioutil.Discard)
+
+	srv := dropboxtest.NewServer()
+	defer srv.Close()
+
+	localPath, err := ioutil.TempDir("", "dropbox_sync")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(localPath)
+
+	store, err := state.Open(filepath.Join(localPath, ignore.ReservedFolder, "state.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	writeLocal(t, localPath, ignore.FileName, "draft.txt\n")
+	writeLocal(t, localPath, "draft.txt", "draft")
+
+	matcher, err := ignore.NewMatcher(localPath, nil, ignore.Selection{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	srv.CreateFolder("/remote")
+
+	client := srv.Client()
+	synchronizer := sync.NewSync(&client, store, matcher, sync.ModeBackup, localPath, "/remote")
+	defer synchronizer.Close()
+
+	err = synchronizer.Reconcile(context.Background())
+	if err != nil {
+		t.Fatalf("can't reconcile: %s", err)
+	}
+
+	expectRemote(t, srv, "/remote/draft.txt", "")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	stopped := make(chan error, 2)
+	go func() { stopped <- synchronizer.DropboxFolder(ctx) }()
+	go func() { stopped <- synchronizer.LocalFolder(ctx) }()
+
+	writeLocal(t, localPath, ignore.FileName, "")
+	eventually(t, "upload of the path no longer ignored", func() bool { return readRemote(srv, "/remote/draft.txt") == "draft" })
+
+	cancel()
+	<-stopped
+	<-stopped
+}
+
+// follow reconciles and follows Dropbox changes until a condition is reached
+func follow(t *testing.T, synchronizer *sync.Sync, condition func() bool) {
+	err := synchronizer.Reconcile(context.Background())
+	if err != nil {
+		t.Fatalf("can't reconcile: %s", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	stopped := make(chan error, 1)
+	go func() { stopped <- synchronizer.DropboxFolder(ctx) }()
+
+	eventually(t, "follow", condition)
+
+	cancel()
+	<-stopped
+}
+
+func writeLocal(t *testing.T, localPath string, name string, content string) {
+	err := ioutil.WriteFile(filepath.Join(localPath, name), []byte(content), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func readLocal(localPath string, name string) string {
+	content, _ := ioutil.ReadFile(filepath.Join(localPath, name))
+
+	return string(content)
+}
+
+func readRemote(srv *dropboxtest.Server, remotePath string) string {
+	content, _ := srv.ReadFile(remotePath)
+
+	return string(content)
+}
+
+func expectLocal(t *testing.T, localPath string, name string, expected string) {
+	if content := readLocal(localPath, name); content != expected {
+		t.Fatalf("expected local '%s' to contain %q, got %q", name, expected, content)
+	}
+}
+
+func expectRemote(t *testing.T, srv *dropboxtest.Server, remotePath string, expected string) {
+	if content := readRemote(srv, remotePath); content != expected {
+		t.Fatalf("expected Dropbox '%s' to contain %q, got %q", remotePath, expected, content)
+	}
+}
+
+// eventually waits for a condition reached by the running synchronizer
+func eventually(t *testing.T, step string, condition func() bool) {
+	deadline := time.Now().Add(10 * time.Second)
+	for !condition() {
+		if time.Now().After(deadline) {
+			t.Fatalf("%s didn't happen", step)
+		}
+
+		time.Sleep(20 * time.Millisecond)
+	}
+}